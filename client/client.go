@@ -2,16 +2,20 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	dir "github.com/sebastian-j-ibanez/fsync/directory"
 	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
 )
 
 const (
@@ -22,12 +26,45 @@ const (
 
 type Client struct {
 	DirMan dir.DirManager
-	Sock   prot.SocketHandler
 	Peers  []prot.Peer
+	// Peers synced at once
+	MaxPeers int
+	// Files uploaded at once over a multiplexed session
+	Parallel int
+	// When to compress if the peer supports compression
+	Compression prot.CompressionMode
+	// Bandwidth schedules, overridden per peer by the peer store
+	// Each caps the total rate of every session using it
+	UploadLimit   *prot.Schedule
+	DownloadLimit *prot.Schedule
+	// Connection deadlines, prot.DefaultTimeouts when nil
+	Timeouts *prot.Timeouts
+	// Retries after transient peer errors, DefaultRetryPolicy when nil
+	Retry *RetryPolicy
+	// Decides incoming syncs before Approve or the prompt, nil to always ask
+	Policy *Policy
+	// Decides incoming syncs in place of the stdin prompt when set
+	Approve func(ctx context.Context, a Approval) (prot.Decision, error)
+	// How the progress of files is shown
+	Progress status.ProgressStyle
+	// Files in flight are listed here when set
+	Transfers *status.Transfers
+	// Called after each sync handled by Serve ends, err is nil on success
+	OnServed func(addr string, started time.Time, err error)
+	// Compare files with peers and print the plan, transferring nothing
+	DryRun bool
+	// File every sync session is appended to, none when empty
+	History string
+
+	// Serializes writers of the same file across sessions
+	locks pathLocks
+	// One prompt on stdin at a time
+	promptMu sync.Mutex
 }
 
 // Await sync from peer over default port
-func (c Client) AwaitSync(portNum int) error {
+// Stops waiting, or abandons the session, once ctx is done
+func (c *Client) AwaitSync(ctx context.Context, portNum int) error {
 	// Set port
 	if portNum == -1 {
 		portNum = defaultPort
@@ -39,249 +76,305 @@ func (c Client) AwaitSync(portNum int) error {
 		return err
 	}
 	defer lis.Close()
+	stopAccept := context.AfterFunc(ctx, func() { lis.Close() })
+	defer stopAccept()
 	fmt.Printf("Listening over port %d...\n", portNum)
 
 	// Accept peer connection
+	idle := c.timeouts().Idle
+	if idle > 0 {
+		lis.(*net.TCPListener).SetDeadline(time.Now().Add(idle))
+	}
 	conn, err := lis.Accept()
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("no peer connected within %s", idle)
+		}
 		return err
 	}
 	fmt.Printf("Connection established with client (%s)\n", conn.RemoteAddr().String())
 
-	c.Sock, err = prot.NewSocketHandler(conn, true)
-	if err != nil {
-		return errors.New("unable to establish connection: " + err.Error())
-	}
-
-	// Send local hashes
-	err = c.SendUniqueHashes(nil)
-	if err != nil {
-		msg := "unable to send file hashes: " + err.Error()
-		return errors.New(msg)
-	}
-
-	// Receive file hashes
-	var uniqueHashes []dir.FileHash
-	uniqueHashes, err = c.ReceiveUniqueHashes()
-	if err != nil {
-		msg := "unable to receive file hashes: " + err.Error()
-		return errors.New(msg)
-	}
-
-	// Confirmation prompt
-	conf, err := c.confirmDownload(uniqueHashes)
-	if err != nil {
-		return err
-	}
-
-	// Send confirmation
-	var confPkt prot.Packet
-	err = confPkt.SerializeToBody(conf, prot.Bool)
-	if err != nil {
-		return err
-	}
-	err = c.Sock.SendEncryptedPacket(confPkt)
-	if err != nil {
-		return err
-	}
+	return c.handleConn(ctx, conn, false)
+}
 
-	if !conf {
-		fmt.Println("Sync aborted...")
-		return nil
+// Receive a sync over an accepted connection, then close it
+// Quiet sessions print one line per file instead of progress bars
+func (c *Client) handleConn(ctx context.Context, conn net.Conn, quiet bool) (err error) {
+	started := time.Now()
+	addr := conn.RemoteAddr().String()
+	var s *session
+	defer func() { emitReceived(addr, s, started, err) }()
+
+	// Apply a registered peer's bandwidth overrides
+	up, down := c.UploadLimit, c.DownloadLimit
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		if peer, ok := prot.LookupPeer(host); ok {
+			up, down, err = peer.BandwidthLimits(up, down)
+			if err != nil {
+				conn.Close()
+				return fmt.Errorf("invalid bandwidth limit for peer %s: %w", peer.Addr(), err)
+			}
+		}
 	}
+	conn = prot.NewLimitedConn(conn, up, down)
 
-	// Tell peer that we are finished
-	var finPkt prot.Packet
-	err = finPkt.SerializeToBody(true, prot.Bool)
-	if err != nil {
-		return err
-	}
-	err = c.Sock.SendEncryptedPacket(finPkt)
+	// Abandon the handshake once ctx is done
+	stopHandshake := context.AfterFunc(ctx, func() { conn.Close() })
+	s, err = c.newSession(conn, true, nil)
+	stopHandshake()
 	if err != nil {
-		return err
+		conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("unable to establish connection: %w", err)
 	}
+	defer s.close()
+	defer func() { c.recordHistory(s, true, started, err) }()
+	s.quiet = s.quiet || quiet
+	stop := s.sock.WatchContext(ctx)
+	defer stop()
 
-	return c.ReceiveUniqueFiles(uniqueHashes)
+	return s.cancelOnError(ctx, s.receiveSync(ctx))
 }
 
 // Init sync with peers
-func (c Client) InitSync(filePattern []string) error {
+// Up to c.MaxPeers peers sync at once, each over its own session and
+// with its own progress line, sharing one hash of the local directory
+// A peer that fails does not stop the others; every peer's outcome is
+// summarized in a *SyncError if any failed
+// Abandons every session once ctx is done
+func (c *Client) InitSync(ctx context.Context, filePattern []string) error {
 	// Get local file hashes
 	localHashes, err := c.DirMan.GetFileHashes(filePattern)
 	if err != nil {
-		msg := "unable to hash directory: " + err.Error()
-		return errors.New(msg)
+		return fmt.Errorf("unable to hash directory: %w", err)
 	}
 
-	for _, peer := range c.Peers {
-		if err := func() error {
-			// Connect to peer, init socket
-			conn, err := net.Dial("tcp", peer.Addr())
-			if err != nil {
-				msg := "unable to establish connection: " + err.Error()
-				return errors.New(msg)
-			}
-			defer func(conn net.Conn) {
-				err := conn.Close()
-				if err != nil {
-					fmt.Println("unable to close connection: " + err.Error())
-				}
-			}(conn)
-			fmt.Printf("Connection established with client (%s)\n", peer.Addr())
-
-			c.Sock, err = prot.NewSocketHandler(conn, false)
-			if err != nil {
-				return errors.New("unable to initialize socket handler: " + err.Error())
-			}
-
-			// Get peer file hashes
-			peerHashes, err := c.ReceiveUniqueHashes()
-			if err != nil {
-				msg := "unable to receive file hashes: " + err.Error()
-				return errors.New(msg)
-			}
-
-			// Send unique file hashes
-			uniqueFiles := dir.GetUniqueHashes(localHashes, peerHashes)
-			err = c.SendUniqueHashes(*uniqueFiles)
-			if err != nil {
-				msg := "unable to send file hashes: " + err.Error()
-				return errors.New(msg)
-			}
-
-			// Receive confirmation packet
-			var confPkt prot.Packet
-			err = c.Sock.ReceiveEncryptedPacket(&confPkt)
-			if err != nil {
-				return fmt.Errorf("failed to receive confirmation: %w", err)
-			}
+	slog.Info("sync started", "dir", c.DirMan.Path, "peers", len(c.Peers), "files", len(localHashes))
+	started := time.Now()
+	limit := min(max(c.MaxPeers, 1), len(c.Peers))
+	var board *status.Board
+	if limit > 1 {
+		board = status.NewBoard()
+	}
 
-			// Check confirmation
-			var result bool
-			err = confPkt.DeserializeBody(&result)
-			if err != nil {
-				msg := "unable to deserialize confirmation: " + err.Error()
-				return errors.New(msg)
-			}
+	results := make([]PeerResult, len(c.Peers))
+	slots := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i, peer := range c.Peers {
+		var line *status.Line
+		if board != nil {
+			line = board.AddLine("%s: waiting", peer.Addr())
+		}
 
-			if result {
-				err := c.SendUniqueFiles(*uniqueFiles)
-				if err != nil {
-					return err
-				}
-			} else {
-				fmt.Println("Client rejected file transfer...")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = PeerResult{Peer: peer, Err: ctx.Err()}
+				return
 			}
+			defer func() { <-slots }()
 
-			// Wait until client is finished transfer
-			var finPkt prot.Packet
-			err = c.Sock.ReceiveEncryptedPacket(&finPkt)
-			if err != nil {
-				return fmt.Errorf("failed to receive confirmation: %w", err)
+			results[i] = c.syncPeerWithRetry(ctx, peer, localHashes, line)
+			if line != nil && results[i].Err != nil {
+				line.Set("%s: \033[31mfailed\033[0m: %v", peer.Addr(), results[i].Err)
 			}
+		}()
+	}
+	wg.Wait()
+	for _, res := range results {
+		slog.Info("sync with peer ended", "peer", res.Peer.Addr(), "attempts", res.Attempts,
+			"files", res.Files, "bytes", res.Bytes, "err", res.Err)
+	}
+	emitSent(results, started)
 
-			var clientIsFinished bool
-			err = finPkt.DeserializeBody(&clientIsFinished)
-			if err != nil {
-				msg := "unable to deserialize confirmation: " + err.Error()
-				return errors.New(msg)
-			}
-			return nil
-		}(); err != nil {
-			return err
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, res := range results {
+		if res.Plan != nil {
+			status.Printf("%s", res.Plan)
+		}
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			return &SyncError{Results: results}
 		}
 	}
-
 	return nil
 }
 
-// Receive file hashes from socket
-func (c Client) ReceiveUniqueHashes() ([]dir.FileHash, error) {
-	uniqueHashes := []dir.FileHash{}
-
-	err := c.Sock.ReceiveEncryptedData(&uniqueHashes, prot.FileHashes)
+// Send local files the peer res.Peer is missing
+// Progress is shown on line when set
+// Records what was sent in res, or what would be when DryRun is set
+func (c *Client) syncPeer(ctx context.Context, res *PeerResult, localHashes []dir.FileHash, line *status.Line) error {
+	peer := res.Peer
+	up, down, err := peer.BandwidthLimits(c.UploadLimit, c.DownloadLimit)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid bandwidth limit for peer %s: %w", peer.Addr(), err)
 	}
 
-	return uniqueHashes, nil
-}
-
-// Sends unique hashes over client socket
-// Default to file hashes of every file in the directory
-func (c Client) SendUniqueHashes(uniqueHashes []dir.FileHash) error {
-	var err error
-	if uniqueHashes == nil {
-		uniqueHashes, err = c.DirMan.GetFileHashes(nil) // Empty slice will default to all files in directory
-		if err != nil {
-			return err
+	// Connect to peer, init socket
+	d := net.Dialer{Timeout: c.timeouts().Dial}
+	conn, err := d.DialContext(ctx, "tcp", peer.Addr())
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		return fmt.Errorf("unable to establish connection: %w", prot.During("connect", err))
 	}
-
-	var pkt prot.Packet
-	err = pkt.SerializeToBody(uniqueHashes, prot.FileHashes)
-	if err != nil {
-		return err
+	conn = prot.NewLimitedConn(conn, up, down)
+	if line == nil {
+		fmt.Printf("Connection established with client (%s)\n", peer.Addr())
 	}
 
-	err = c.Sock.SendEncryptedPacket(pkt)
+	// Abandon the handshake once ctx is done
+	started := time.Now()
+	stopHandshake := context.AfterFunc(ctx, func() { conn.Close() })
+	s, err := c.newSession(conn, false, line)
+	stopHandshake()
 	if err != nil {
-		return err
+		conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("unable to initialize socket handler: %w", err)
+	}
+	defer func() {
+		if err := s.close(); err != nil {
+			s.log.Warn("unable to close connection", "err", err)
+		}
+	}()
+	stop := s.sock.WatchContext(ctx)
+	defer stop()
+
+	err = s.cancelOnError(ctx, s.sendSync(ctx, localHashes))
+	c.recordHistory(s, false, started, err)
+	res.Plan = s.plan
+	res.accepted = s.accepted
+	if err == nil {
+		res.Files, res.Bytes = s.files, s.bytes
 	}
+	return err
+}
 
-	return nil
+// Deadlines for new connections
+func (c *Client) timeouts() prot.Timeouts {
+	if c.Timeouts == nil {
+		return prot.DefaultTimeouts()
+	}
+	return *c.Timeouts
 }
 
-func (c Client) SendUniqueFiles(uniqueFiles []dir.FileHash) error {
-	var err error
-	for _, file := range uniqueFiles {
-		path := c.DirMan.Path + "/" + file.Name
-		err = c.Sock.UploadFile(path)
-		if err != nil {
-			msg := "unable to upload " + file.Name + ": " + err.Error()
-			return errors.New(msg)
-		}
+// Resolve a peer-supplied file name inside the synced directory
+func (c *Client) localPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid file name %q", name)
 	}
+	return filepath.Join(c.DirMan.Path, name), nil
+}
 
-	return nil
+// Incoming sync waiting for the user's decision
+type Approval struct {
+	// Hostname and address of the sending peer
+	Peer  string         `json:"peer"`
+	Addr  string         `json:"addr"`
+	Files []dir.FileHash `json:"files"`
+	Total int64          `json:"total"`
+	// Incoming files that would replace different local files
+	Conflicts []string `json:"conflicts,omitempty"`
+	// Whether the peer can send only some of the files
+	Selectable bool `json:"selectable"`
 }
 
-func (c Client) ReceiveUniqueFiles(uniqueHashes []dir.FileHash) error {
-	var err error
+// Describe the files peer wants to send
+func (c *Client) newApproval(peer, addr string, uniqueHashes []dir.FileHash, selectable bool) Approval {
+	a := Approval{
+		Peer:       peer,
+		Addr:       addr,
+		Files:      uniqueHashes,
+		Total:      totalSize(uniqueHashes),
+		Selectable: selectable,
+	}
 	for _, file := range uniqueHashes {
-		err = c.Sock.DownloadFile(file.Name)
+		path, err := c.localPath(file.Name)
 		if err != nil {
-			msg := "unable to download " + file.Name + ": " + err.Error()
-			return errors.New(msg)
+			continue
+		}
+		// Files are only offered when their content differs from ours
+		if _, err := os.Stat(path); err == nil {
+			a.Conflicts = append(a.Conflicts, file.Name)
 		}
 	}
+	return a
+}
+
+// Decide whether to accept the files in a
+// The policy decides first, then Approve when set, then the user on stdin
+// Prompts on stdin from concurrent sessions wait their turn
+// Gives up once ctx is done
+func (c *Client) confirmDownload(ctx context.Context, a Approval) (prot.Decision, error) {
+	if d, ok := c.Policy.decide(a); ok {
+		slog.Info("policy decided sync", "peer", a.Addr, "hostname", a.Peer,
+			"accepted", d.Accepted, "reason", d.Reason)
+		return d, nil
+	}
 
-	return nil
+	if c.Approve != nil {
+		return c.Approve(ctx, a)
+	}
+	return c.promptDownload(ctx, a)
 }
 
-func (c Client) confirmDownload(uniqueHashes []dir.FileHash) (bool, error) {
-	for {
-		// fmt.Println("\033[1mFiles\t\t\t\tSize\033[0m")
-		totalSize := int64(0)
-		for _, file := range uniqueHashes {
-			// fmt.Printf("\033[1m%s\t\t\t\t%d\033[0m\n", file.Name, file.Size)
-			totalSize += file.Size
-		}
+// Line typed on stdin, or why none could be read
+type stdinLine struct {
+	text string
+	err  error
+}
 
-		fmt.Printf("\nTotal size: \033[1m%d\033[0m\n", totalSize)
-		fmt.Print("Proceed with download? [y/n]: ")
+var (
+	stdinOnce  sync.Once
+	stdinLines chan stdinLine
+)
 
-		reader := bufio.NewReader(os.Stdin)
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			return false, err
-		}
+// Lines typed on stdin
+// One goroutine reads for every prompt, so a canceled prompt never
+// swallows the answer to the next one
+func readStdin() <-chan stdinLine {
+	stdinOnce.Do(func() {
+		stdinLines = make(chan stdinLine)
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			for {
+				text, err := reader.ReadString('\n')
+				if text != "" {
+					stdinLines <- stdinLine{text: text}
+				}
+				if err != nil {
+					// Stdin is gone for good
+					for {
+						stdinLines <- stdinLine{err: err}
+					}
+				}
+			}
+		}()
+	})
+	return stdinLines
+}
 
-		switch strings.TrimSpace(input) {
-		case "y":
-			return true, nil
-		case "n":
-			return false, nil
-		}
+// Sum the sizes of files in a hash list
+func totalSize(hashes []dir.FileHash) int64 {
+	total := int64(0)
+	for _, file := range hashes {
+		total += file.Size
 	}
+	return total
 }
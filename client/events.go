@@ -0,0 +1,62 @@
+package client
+
+import (
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Emit the start of a session with the peer's hello and features
+func (s *session) emitStart(listenFlag bool) {
+	direction := "send"
+	if listenFlag {
+		direction = "receive"
+	}
+	h := s.sock.PeerHello
+	status.Emit(status.Event{
+		Type:      status.EventSessionStart,
+		Peer:      s.addr,
+		Hostname:  h.Hostname,
+		Direction: direction,
+		Version:   h.SoftwareVersion,
+		Features:  s.sock.Capabilities.String(),
+	})
+}
+
+// Emit the outcome of a sync received from addr over s
+// s is nil when the session could not be set up
+func emitReceived(addr string, s *session, started time.Time, err error) {
+	summary := status.Event{
+		Type:      status.EventSummary,
+		Peer:      addr,
+		Direction: "receive",
+		Peers:     1,
+		Duration:  time.Since(started).Seconds(),
+	}
+	if err != nil {
+		status.Emit(status.Event{Type: status.EventError, Peer: addr, Error: err.Error()})
+		summary.Failed = 1
+	} else if s != nil {
+		summary.Files, summary.Bytes = s.files, s.bytes
+	}
+	status.Emit(summary)
+}
+
+// Emit an error for each peer that failed, then the outcome of the sync
+func emitSent(results []PeerResult, started time.Time) {
+	summary := status.Event{
+		Type:      status.EventSummary,
+		Direction: "send",
+		Peers:     len(results),
+		Duration:  time.Since(started).Seconds(),
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			status.Emit(status.Event{Type: status.EventError, Peer: res.Peer.Addr(), Error: res.Err.Error()})
+			summary.Failed++
+		}
+		summary.Files += res.Files
+		summary.Bytes += res.Bytes
+	}
+	status.Emit(summary)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/history"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Append the outcome of session s, started at started, to the client's history
+// Dry runs and syncs that had nothing to transfer are not recorded
+func (c *Client) recordHistory(s *session, listenFlag bool, started time.Time, err error) {
+	if c.History == "" || c.DryRun || s == nil {
+		return
+	}
+
+	e := history.Entry{
+		Time:      started,
+		Peer:      s.addr,
+		Hostname:  s.sock.PeerHello.Hostname,
+		Direction: "send",
+		Duration:  time.Since(started).Seconds(),
+		Result:    history.ResultCompleted,
+	}
+	if listenFlag {
+		e.Direction = "receive"
+	}
+	s.mu.Lock()
+	for _, file := range s.synced {
+		if s.transferred[file.Name] {
+			e.Files = append(e.Files, history.File{Name: file.Name, Size: file.Size, Hash: file.Hash})
+			e.Bytes += file.Size
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case err == nil && s.rejected != nil:
+		e.Result = history.ResultRejected
+		e.Error = s.rejected.Reason
+	case err == nil:
+		if len(e.Files) == 0 {
+			return
+		}
+	case errors.Is(err, context.Canceled) || errors.Is(err, prot.ErrPeerCanceled):
+		e.Result = history.ResultCanceled
+	case errors.Is(err, prot.ErrRejected):
+		e.Result = history.ResultRejected
+	default:
+		e.Result = history.ResultFailed
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if err := history.Append(c.History, e); err != nil {
+		s.log.Warn("unable to record sync history", "err", err)
+	}
+}
+
+// Reporter noting each file the session finished sending
+// Received files are noted once verified, see verifyReceived
+type historyReporter struct {
+	s *session
+}
+
+type historyReport struct {
+	s    *session
+	name string
+}
+
+func (r historyReporter) Start(t status.FileTransfer) status.FileReport {
+	if !t.Upload {
+		return status.Silent.Start(t)
+	}
+	return historyReport{s: r.s, name: t.File}
+}
+
+func (historyReport) Progress(int64) {}
+
+func (r historyReport) Done(err error) {
+	if err != nil {
+		return
+	}
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.s.transferred == nil {
+		r.s.transferred = map[string]bool{}
+	}
+	r.s.transferred[r.name] = true
+}
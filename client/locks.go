@@ -0,0 +1,42 @@
+package client
+
+import "sync"
+
+// Per-path locks so concurrent sessions never write the same file at once
+// The zero value is ready to use
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	mu sync.Mutex
+	// Holders and waiters, the entry is dropped when it reaches zero
+	refs int
+}
+
+// Block until path is free, then hold it until the returned function is called
+func (l *pathLocks) lock(path string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*pathLock)
+	}
+	pl, ok := l.locks[path]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[path] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.mu.Lock()
+	return func() {
+		pl.mu.Unlock()
+		l.mu.Lock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, path)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -39,6 +40,39 @@ func DiscoverMDNSService() (prot.Peer, error) {
 	}
 }
 
+// Discover every fsync service answering within wait
+func DiscoverMDNSPeers(ctx context.Context, wait time.Duration) ([]prot.Peer, error) {
+	entryCh := make(chan *mdns.ServiceEntry, 16)
+	done := make(chan struct{})
+	var peers []prot.Peer
+	go func() {
+		defer close(done)
+		seen := make(map[string]bool)
+		for service := range entryCh {
+			if service.AddrV4 == nil {
+				continue
+			}
+			peer := prot.Peer{
+				IP:   service.AddrV4.String(),
+				Port: strconv.Itoa(service.Port),
+			}
+			if !seen[peer.Addr()] {
+				seen[peer.Addr()] = true
+				peers = append(peers, peer)
+			}
+		}
+	}()
+
+	params := mdns.DefaultParams(serviceName)
+	params.Entries = entryCh
+	params.Timeout = wait
+	params.DisableIPv6 = true
+	err := mdns.QueryContext(ctx, params)
+	close(entryCh)
+	<-done
+	return peers, err
+}
+
 // Start mDNS service for other peers to connect to
 func BroadcastMDNSService(port int, endBroadcast <-chan bool) error {
 	// Setup our service export
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// What a sync would do to the receiving folder, worked out by a dry run
+type Plan struct {
+	// Hostname and address of the peer
+	Peer string
+	Addr string
+	// Files the receiver does not have
+	Creates []dir.FileHash
+	// Files replacing a different version on the receiver
+	Overwrites []dir.FileHash
+	// Files that could not be written, e.g. a directory is in the way
+	Conflicts []dir.FileHash
+	// Files removed from the receiver, always empty as fsync never deletes
+	Deletes []dir.FileHash
+}
+
+// Plan sending the unique local files to a peer holding peerHashes
+// Conflicts are only known to the receiving side
+func planSend(peer, addr string, uniqueFiles, peerHashes []dir.FileHash) Plan {
+	p := Plan{Peer: peer, Addr: addr}
+	names := make(map[string]bool, len(peerHashes))
+	for _, file := range peerHashes {
+		names[file.Name] = true
+	}
+	for _, file := range uniqueFiles {
+		if names[file.Name] {
+			p.Overwrites = append(p.Overwrites, file)
+		} else {
+			p.Creates = append(p.Creates, file)
+		}
+	}
+	return p
+}
+
+// Plan receiving the files offered by a peer into the synced directory
+func (c *Client) planReceive(peer, addr string, uniqueHashes []dir.FileHash) Plan {
+	p := Plan{Peer: peer, Addr: addr}
+	for _, file := range uniqueHashes {
+		path, err := c.localPath(file.Name)
+		if err != nil {
+			p.Conflicts = append(p.Conflicts, file)
+			continue
+		}
+		info, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			p.Creates = append(p.Creates, file)
+		case info.Mode().IsRegular():
+			p.Overwrites = append(p.Overwrites, file)
+		default:
+			p.Conflicts = append(p.Conflicts, file)
+		}
+	}
+	return p
+}
+
+// Size of the files the sync would transfer
+func (p Plan) Bytes() int64 {
+	return totalSize(p.Creates) + totalSize(p.Overwrites)
+}
+
+// List every planned change followed by a summary
+func (p Plan) String() string {
+	width := 0
+	for _, list := range [][]dir.FileHash{p.Creates, p.Overwrites, p.Conflicts} {
+		for _, file := range list {
+			width = max(width, len(file.Name))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dry run with \033[1m%s\033[0m (%s), nothing was transferred:\n", p.Peer, p.Addr)
+	add := func(action string, files []dir.FileHash) {
+		for _, file := range files {
+			fmt.Fprintf(&b, "  %-9s  %-*s  %10s\n", action, width, file.Name, status.FormatBytes(file.Size))
+		}
+	}
+	add("create", p.Creates)
+	add("overwrite", p.Overwrites)
+	add("conflict", p.Conflicts)
+	add("delete", p.Deletes)
+	fmt.Fprintf(&b, "%d creates, %d overwrites, %d deletes, %d conflicts, %s to transfer\n",
+		len(p.Creates), len(p.Overwrites), len(p.Deletes), len(p.Conflicts), status.FormatBytes(p.Bytes()))
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Rules deciding incoming syncs without prompting
+// Syncs breaking a rule are rejected with the reason sent to the peer
+// Syncs passing every rule are accepted when the policy has any rule,
+// AcceptAll is set or the peer is in AutoAcceptFrom, otherwise the user
+// is asked
+type Policy struct {
+	// Accept every sync that passes the rules
+	AcceptAll bool `json:"accept_all"`
+	// Accept syncs from these peers, by IP or IP:PORT
+	AutoAcceptFrom []string `json:"auto_accept_from"`
+	// Reject syncs larger than this in total, e.g. 500M, empty for no limit
+	MaxTotalSize string `json:"max_total_size"`
+	// Reject files with other extensions, e.g. .jpg, empty for any
+	AllowedExtensions []string `json:"allowed_extensions"`
+	// Reject other peers, by IP or IP:PORT, empty for any
+	AllowedPeers []string `json:"allowed_peers"`
+}
+
+// Read a policy from the JSON file at path
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	if err := p.Check(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Report the first malformed rule
+func (p *Policy) Check() error {
+	if p.MaxTotalSize != "" {
+		if _, err := status.ParseSize(p.MaxTotalSize); err != nil {
+			return fmt.Errorf("max_total_size: %w", err)
+		}
+	}
+	for _, ext := range p.AllowedExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("allowed_extensions: %q must start with a dot", ext)
+		}
+	}
+	for _, peer := range p.AutoAcceptFrom {
+		if err := checkPeer(peer); err != nil {
+			return fmt.Errorf("auto_accept_from: %w", err)
+		}
+	}
+	for _, peer := range p.AllowedPeers {
+		if err := checkPeer(peer); err != nil {
+			return fmt.Errorf("allowed_peers: %w", err)
+		}
+	}
+	return nil
+}
+
+// Decide a without prompting if the policy allows
+// Reports false when the user has to be asked
+func (p *Policy) decide(a Approval) (prot.Decision, bool) {
+	if p == nil {
+		return prot.Decision{}, false
+	}
+
+	if len(p.AllowedPeers) > 0 && !matchesPeer(p.AllowedPeers, a) {
+		return reject("peer %s is not allowed", a.Addr), true
+	}
+	if max, err := status.ParseSize(p.MaxTotalSize); err == nil && a.Total > max {
+		return reject("%s exceeds the limit of %s", status.FormatBytes(a.Total), status.FormatBytes(max)), true
+	}
+	if len(p.AllowedExtensions) > 0 {
+		for _, file := range a.Files {
+			ext := strings.ToLower(filepath.Ext(file.Name))
+			if !slices.ContainsFunc(p.AllowedExtensions, func(allowed string) bool {
+				return strings.ToLower(allowed) == ext
+			}) {
+				return reject("file type of %s is not allowed", file.Name), true
+			}
+		}
+	}
+
+	hasRules := p.MaxTotalSize != "" || len(p.AllowedExtensions) > 0 || len(p.AllowedPeers) > 0
+	if hasRules || p.AcceptAll || matchesPeer(p.AutoAcceptFrom, a) {
+		return prot.Decision{Accepted: true}, true
+	}
+	return prot.Decision{}, false
+}
+
+func reject(format string, a ...any) prot.Decision {
+	return prot.Decision{Reason: fmt.Sprintf(format, a...)}
+}
+
+// Report whether a comes from one of peers, named by IP or IP:PORT
+// Only the connection's address counts, the hostname in the peer's hello
+// is unauthenticated and any host can claim it
+func matchesPeer(peers []string, a Approval) bool {
+	host, port, err := net.SplitHostPort(a.Addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, peer := range peers {
+		peerIP, peerPort := peer, ""
+		if h, p, err := net.SplitHostPort(peer); err == nil {
+			peerIP, peerPort = h, p
+		}
+		if ip.Equal(net.ParseIP(peerIP)) && (peerPort == "" || peerPort == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report a peer that is not an IP or IP:PORT
+func checkPeer(peer string) error {
+	host := peer
+	if h, _, err := net.SplitHostPort(peer); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an IP or IP:PORT, hostnames are not trusted", peer)
+	}
+	return nil
+}
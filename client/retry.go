@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// How often and how patiently to retry a peer after a transient error
+type RetryPolicy struct {
+	// Attempts after the first, 0 to never retry
+	Retries int
+	// Delay before the first retry, doubled for each one after
+	BaseDelay time.Duration
+	// Longest delay between attempts
+	MaxDelay time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Retries:   3,
+		BaseDelay: time.Second,
+		MaxDelay:  30 * time.Second,
+	}
+}
+
+// Delay before retry n, counting from 1
+// Jittered between half and all of the exponential delay so peers
+// retrying together spread out
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 {
+		d = min(d, p.MaxDelay)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Outcome of syncing with one peer
+type PeerResult struct {
+	Peer     prot.Peer
+	Attempts int
+	Err      error
+	// Files and bytes sent, set once the sync succeeded
+	Files int
+	Bytes int64
+	// What the sync would have done, set by dry runs
+	Plan *Plan
+	// Set once the peer accepted the files, retrying would ask it again
+	accepted bool
+}
+
+// One or more peers failed to sync
+type SyncError struct {
+	Results []PeerResult
+}
+
+func (e *SyncError) Error() string {
+	failed := 0
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "sync failed for %d of %d peers", failed, len(e.Results))
+	for _, r := range e.Results {
+		fmt.Fprintf(&b, "\n  %s: ", r.Peer.Addr())
+		if r.Err == nil {
+			b.WriteString("ok")
+		} else {
+			b.WriteString(r.Err.Error())
+		}
+		if r.Attempts > 1 {
+			fmt.Fprintf(&b, " (%d attempts)", r.Attempts)
+		}
+	}
+	return b.String()
+}
+
+func (e *SyncError) Unwrap() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errs
+}
+
+// Sync with peer, retrying transient failures with backoff until the
+// peer accepted the files
+func (c *Client) syncPeerWithRetry(ctx context.Context, peer prot.Peer, localHashes []dir.FileHash, line *status.Line) PeerResult {
+	policy := c.retryPolicy()
+	res := PeerResult{Peer: peer}
+	for {
+		res.Attempts++
+		res.Err = c.syncPeer(ctx, &res, localHashes, line)
+		if res.Err == nil || ctx.Err() != nil || res.Attempts > policy.Retries || res.accepted || !isTransient(res.Err) {
+			return res
+		}
+
+		wait := policy.delay(res.Attempts)
+		slog.Warn("retrying peer", "peer", peer.Addr(), "in", wait.Round(time.Millisecond),
+			"attempt", res.Attempts+1, "of", policy.Retries+1, "err", res.Err)
+		if line != nil {
+			line.Set("Retrying %s in %s (attempt %d of %d): %v",
+				peer.Addr(), wait.Round(time.Millisecond), res.Attempts+1, policy.Retries+1, res.Err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return res
+		}
+	}
+}
+
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.Retry == nil {
+		return DefaultRetryPolicy()
+	}
+	return *c.Retry
+}
+
+// Report whether err may go away on its own, e.g. a peer that is
+// restarting or a flaky network
+// Errors from the peer's user or a misbehaving peer are final
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, prot.ErrPeerCanceled) {
+		return false
+	}
+
+	// Retrying would prompt the peer's user again
+	var te *prot.TimeoutError
+	if errors.As(err, &te) {
+		return te.Op != "confirmation"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
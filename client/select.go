@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Offered files and which of them the user picked
+type fileSelection struct {
+	files  []dir.FileHash
+	picked []bool
+}
+
+// Selection with every file picked
+func newFileSelection(files []dir.FileHash) *fileSelection {
+	sel := &fileSelection{
+		files:  files,
+		picked: make([]bool, len(files)),
+	}
+	sel.setAll(true)
+	return sel
+}
+
+func (sel *fileSelection) setAll(picked bool) {
+	for i := range sel.picked {
+		sel.picked[i] = picked
+	}
+}
+
+// Toggle the files named by each field of input: a number, a range
+// such as 3-5, or a pattern such as *.jpg
+func (sel *fileSelection) toggle(input string) error {
+	// Check every field before toggling any
+	var indexes []int
+	for _, field := range strings.Fields(input) {
+		matched, err := sel.match(field)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, matched...)
+	}
+	for _, i := range indexes {
+		sel.picked[i] = !sel.picked[i]
+	}
+	return nil
+}
+
+// Indexes of the files named by field
+func (sel *fileSelection) match(field string) ([]int, error) {
+	lo, hi, isRange := strings.Cut(field, "-")
+	first, err1 := strconv.Atoi(lo)
+	last, err2 := strconv.Atoi(hi)
+	if !isRange {
+		last, err2 = first, err1
+	}
+	if err1 == nil && err2 == nil {
+		if first < 1 || last > len(sel.files) || first > last {
+			return nil, fmt.Errorf("no files numbered %s, expected 1 to %d", field, len(sel.files))
+		}
+		var indexes []int
+		for i := first; i <= last; i++ {
+			indexes = append(indexes, i-1)
+		}
+		return indexes, nil
+	}
+
+	var indexes []int
+	for i, file := range sel.files {
+		ok, err := filepath.Match(field, file.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", field)
+		}
+		if ok {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("no files match %q", field)
+	}
+	return indexes, nil
+}
+
+// Number and total size of the picked files
+func (sel *fileSelection) count() (int, int64) {
+	n, size := 0, int64(0)
+	for i, file := range sel.files {
+		if sel.picked[i] {
+			n++
+			size += file.Size
+		}
+	}
+	return n, size
+}
+
+// Names of the picked files, nil when every file is picked
+func (sel *fileSelection) names() []string {
+	if n, _ := sel.count(); n == len(sel.files) {
+		return nil
+	}
+	names := []string{}
+	for i, file := range sel.files {
+		if sel.picked[i] {
+			names = append(names, file.Name)
+		}
+	}
+	return names
+}
+
+// List the files, marking picked ones and those replacing local files
+func (sel *fileSelection) print(conflicts []string) {
+	width := 0
+	for _, file := range sel.files {
+		width = max(width, len(file.Name))
+	}
+	digits := len(strconv.Itoa(len(sel.files)))
+	for i, file := range sel.files {
+		mark := " "
+		if sel.picked[i] {
+			mark = "x"
+		}
+		note := ""
+		if slices.Contains(conflicts, file.Name) {
+			note = "  \033[33mreplaces local file\033[0m"
+		}
+		fmt.Printf("  [%s] %*d  %-*s  %10s%s\n", mark, digits, i+1, width, file.Name, status.FormatBytes(file.Size), note)
+	}
+}
+
+// Ask the user on stdin which files in a to accept
+// y accepts the picked files and n rejects them all. When the peer
+// supports selection, numbers, ranges and patterns toggle files
+func (c *Client) promptDownload(ctx context.Context, a Approval) (prot.Decision, error) {
+	c.promptMu.Lock()
+	defer c.promptMu.Unlock()
+
+	sel := newFileSelection(a.Files)
+	fmt.Printf("\nFiles offered by \033[1m%s\033[0m (%s):\n", a.Peer, a.Addr)
+	list := true
+	for {
+		if list {
+			sel.print(a.Conflicts)
+			list = false
+		}
+		n, size := sel.count()
+		fmt.Printf("Download %d of %d files (\033[1m%s\033[0m)? ", n, len(sel.files), status.FormatBytes(size))
+		if a.Selectable {
+			fmt.Print("[y/n, or toggle files by number, range or pattern, all, none, ? to list]: ")
+		} else {
+			fmt.Print("[y/n]: ")
+		}
+
+		var line stdinLine
+		select {
+		case line = <-readStdin():
+		case <-ctx.Done():
+			fmt.Println()
+			return prot.Decision{}, ctx.Err()
+		}
+		if line.err != nil {
+			return prot.Decision{}, line.err
+		}
+
+		input := strings.TrimSpace(line.text)
+		switch input {
+		case "y":
+			if n == 0 {
+				fmt.Println("No files selected")
+				continue
+			}
+			return prot.Decision{Accepted: true, Files: sel.names()}, nil
+		case "n":
+			return prot.Decision{Reason: "declined by user"}, nil
+		case "":
+			continue
+		}
+		if !a.Selectable {
+			continue
+		}
+
+		switch input {
+		case "all":
+			sel.setAll(true)
+		case "none":
+			sel.setAll(false)
+		case "?":
+		default:
+			if err := sel.toggle(input); err != nil {
+				fmt.Printf("%v\n", err)
+				continue
+			}
+		}
+		list = true
+	}
+}
+
+// Narrow files to those named in the peer's selection
+// Names that were not offered, or are repeated, are an error
+func selectFiles(files []dir.FileHash, names []string) ([]dir.FileHash, error) {
+	if names == nil {
+		return files, nil
+	}
+
+	offered := make(map[string]dir.FileHash, len(files))
+	for _, file := range files {
+		offered[file.Name] = file
+	}
+	selected := make([]dir.FileHash, 0, len(names))
+	for _, name := range names {
+		file, ok := offered[name]
+		if !ok {
+			return nil, fmt.Errorf("peer selected %q, which was not offered", name)
+		}
+		delete(offered, name)
+		selected = append(selected, file)
+	}
+	return selected, nil
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Pause after a failed accept, e.g. when out of file descriptors
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Serve sync requests from any number of peers at once until ctx is done
+// Each peer gets its own session; sessions still running when ctx is
+// done are canceled and waited for
+func (c *Client) Serve(ctx context.Context, portNum int) error {
+	if portNum == -1 {
+		portNum = defaultPort
+	}
+	port := "0.0.0.0:" + strconv.Itoa(portNum)
+
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving over port %d...\n", portNum)
+
+	return c.ServeListener(ctx, lis)
+}
+
+// Accept connections on lis until it is closed or ctx is done, then
+// close it and wait for the syncs in progress
+func (c *Client) ServeListener(ctx context.Context, lis net.Listener) error {
+	defer lis.Close()
+	stopAccept := context.AfterFunc(ctx, func() { lis.Close() })
+	defer stopAccept()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			slog.Error("unable to accept connection", "err", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		addr := conn.RemoteAddr().String()
+		status.Printf("Connection established with client (%s)\n", addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			err := c.handleConn(ctx, conn, true)
+			switch {
+			case errors.Is(err, context.Canceled):
+				slog.Info("served sync canceled", "peer", addr, "duration", time.Since(started))
+				status.Printf("Sync with %s canceled\n", addr)
+			case err != nil:
+				slog.Error("served sync failed", "peer", addr, "duration", time.Since(started), "err", err)
+			default:
+				slog.Info("served sync", "peer", addr, "duration", time.Since(started))
+				status.Printf("Sync with %s completed\n", addr)
+			}
+			if c.OnServed != nil {
+				c.OnServed(addr, started, err)
+			}
+		}()
+	}
+}
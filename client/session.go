@@ -0,0 +1,394 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// One encrypted connection to a peer
+// Concurrent syncs each run their own session
+type session struct {
+	c    *Client
+	addr string
+	log  *slog.Logger
+	sock prot.SocketHandler
+	// Set when both peers support multiplexing
+	mux *prot.Mux
+	// Progress line while syncing peers concurrently, otherwise nil
+	line *status.Line
+	// Print one line per file instead of redrawn progress
+	quiet bool
+	// What the sync would do, set by dry runs
+	plan *Plan
+
+	// Files sent so far, guarded by mu
+	mu        sync.Mutex
+	sentFiles int
+	sentBytes int64
+	files     int
+	bytes     int64
+	// Files agreed on for transfer, and names of those transferred,
+	// received files only once their content is verified
+	synced      []dir.FileHash
+	transferred map[string]bool
+
+	// Set when the files offered by the peer were rejected
+	rejected *prot.Decision
+	// Set once the peer accepted the files offered to it
+	accepted bool
+}
+
+// Set up an encrypted session over conn
+// Multiplexes the session when both peers support it
+func (c *Client) newSession(conn net.Conn, listenFlag bool, line *status.Line) (*session, error) {
+	s := &session{
+		c:    c,
+		addr: conn.RemoteAddr().String(),
+		line: line,
+	}
+	s.log = slog.With("peer", s.addr)
+
+	var err error
+	s.sock, err = prot.NewSocketHandlerWithTimeouts(conn, listenFlag, c.timeouts())
+	if err != nil {
+		return nil, err
+	}
+	s.sock.Compression = c.Compression
+	// Redrawn progress would tear the event stream
+	s.quiet = status.EventsEnabled()
+	s.printPeerInfo()
+	s.emitStart(listenFlag)
+
+	if s.sock.Supports(prot.CapMultiplex) {
+		s.mux = prot.NewMux(&s.sock, !listenFlag)
+	}
+	return s, nil
+}
+
+// Close the session's connection
+func (s *session) close() error {
+	if s.mux != nil {
+		return s.mux.Close()
+	}
+	return s.sock.Conn.Close()
+}
+
+// Transport for hash lists, confirmations and other control traffic
+func (s *session) control() prot.Transport {
+	if s.mux != nil {
+		return s.mux.Control()
+	}
+	return &s.sock
+}
+
+// Print a message, or show it on the session's progress line
+func (s *session) printf(format string, a ...any) {
+	if s.line != nil {
+		s.line.Set("%s: %s", s.addr, fmt.Sprintf(format, a...))
+		return
+	}
+	status.Printf(format, a...)
+}
+
+// Show a message on the session's progress line, if it has one
+func (s *session) report(format string, a ...any) {
+	if s.line != nil {
+		s.line.Set("%s: %s", s.addr, fmt.Sprintf(format, a...))
+	}
+}
+
+// Show the progress of the session's files in the client's style
+// Concurrent transfers rule out per-file bars, quiet sessions get log lines
+// and sessions on the progress board show nothing of their own
+func (s *session) useReporter(concurrent bool) {
+	style := s.c.Progress
+	switch {
+	case s.line != nil:
+		style = status.ProgressNone
+	case s.quiet && style != status.ProgressNone:
+		style = status.ProgressLog
+	case concurrent && style == status.ProgressBar:
+		style = status.ProgressLog
+	}
+
+	reporters := []status.Reporter{status.NewReporter(style, s.files, s.bytes)}
+	if s.c.Transfers != nil {
+		reporters = append(reporters, s.c.Transfers)
+	}
+	if status.EventsEnabled() {
+		reporters = append(reporters, status.EventReporter{})
+	}
+	if s.c.History != "" {
+		reporters = append(reporters, historyReporter{s: s})
+	}
+	s.sock.Reporter = status.Multi(reporters...)
+}
+
+// Print the peer's hello and the negotiated session features
+func (s *session) printPeerInfo() {
+	h := s.sock.PeerHello
+	s.printf("Peer \033[1m%s\033[0m running fsync %s (protocol v%d, features: %s)\n",
+		h.Hostname, h.SoftwareVersion, s.sock.Version, s.sock.Capabilities)
+}
+
+// Record that files were sent and show the session's progress
+func (s *session) filesSent(n int, size int64) {
+	s.mu.Lock()
+	s.sentFiles += n
+	s.sentBytes += size
+	sentFiles, sentBytes := s.sentFiles, s.sentBytes
+	s.mu.Unlock()
+
+	s.report("sent %d/%d files (%s of %s)", sentFiles, s.files,
+		status.FormatBytes(sentBytes), status.FormatBytes(s.bytes))
+}
+
+// Listener side of a sync session
+func (s *session) receiveSync(ctx context.Context) error {
+	// Send local hashes
+	err := s.sendUniqueHashes(nil)
+	if err != nil {
+		return fmt.Errorf("unable to send file hashes: %w", prot.During("hash exchange", err))
+	}
+
+	// Receive file hashes
+	var uniqueHashes []dir.FileHash
+	uniqueHashes, err = s.receiveUniqueHashes()
+	if err != nil {
+		return fmt.Errorf("unable to receive file hashes: %w", prot.During("hash exchange", err))
+	}
+
+	s.log.Debug("peer offered files", "files", len(uniqueHashes), "bytes", totalSize(uniqueHashes))
+
+	// Stop once the plan is known, the peer sees the sync canceled
+	if len(uniqueHashes) > 0 && s.c.DryRun {
+		plan := s.c.planReceive(s.sock.PeerHello.Hostname, s.addr, uniqueHashes)
+		s.plan = &plan
+		s.printf("%s", plan)
+		s.sock.SendCancel("dry run")
+		return nil
+	}
+
+	// Confirmation prompt, unless there is nothing to accept
+	decision := prot.Decision{Accepted: true}
+	if len(uniqueHashes) > 0 {
+		a := s.c.newApproval(s.sock.PeerHello.Hostname, s.addr, uniqueHashes, s.sock.Supports(prot.CapSelection))
+		decision, err = s.c.confirmDownload(ctx, a)
+		if err != nil {
+			return err
+		}
+		uniqueHashes, err = selectFiles(uniqueHashes, decision.Files)
+		if err != nil {
+			return err
+		}
+	} else {
+		s.printf("Already in sync with %s\n", s.addr)
+	}
+
+	// Send confirmation
+	s.log.Info("decided sync", "accepted", decision.Accepted, "reason", decision.Reason,
+		"files", len(uniqueHashes), "bytes", totalSize(uniqueHashes))
+	err = s.sock.SendDecision(s.control(), decision)
+	if err != nil {
+		return prot.During("confirmation", err)
+	}
+
+	if !decision.Accepted {
+		s.printf("Sync aborted: %s\n", decision.Reason)
+		s.rejected = &decision
+		return nil
+	}
+
+	// Accept no more file data than the user agreed to
+	s.files, s.bytes = len(uniqueHashes), totalSize(uniqueHashes)
+	s.synced = uniqueHashes
+	s.sock.Limits.MaxSessionBytes = s.bytes
+
+	err = s.receiveUniqueFiles(ctx, uniqueHashes)
+	if err != nil {
+		return prot.During("file transfer", err)
+	}
+
+	// Tell peer that we are finished
+	var finPkt prot.Packet
+	err = finPkt.SerializeToBody(true, prot.Bool)
+	if err != nil {
+		return err
+	}
+	return prot.During("completion", s.control().SendEncryptedPacket(finPkt))
+}
+
+// Initiator side of a sync session
+func (s *session) sendSync(ctx context.Context, localHashes []dir.FileHash) error {
+	// Get peer file hashes
+	s.report("comparing files")
+	peerHashes, err := s.receiveUniqueHashes()
+	if err != nil {
+		return fmt.Errorf("unable to receive file hashes: %w", prot.During("hash exchange", err))
+	}
+
+	// Stop once the plan is known, the peer sees the sync canceled
+	uniqueFiles := dir.GetUniqueHashes(localHashes, peerHashes)
+	s.log.Debug("compared files", "local", len(localHashes), "peer", len(peerHashes), "unique", len(*uniqueFiles))
+	if s.c.DryRun {
+		plan := planSend(s.sock.PeerHello.Hostname, s.addr, *uniqueFiles, peerHashes)
+		s.plan = &plan
+		s.report("\033[32mdry run\033[0m, would send %d files (%s)", len(*uniqueFiles), status.FormatBytes(plan.Bytes()))
+		s.sock.SendCancel("dry run")
+		return nil
+	}
+
+	// Send unique file hashes, an empty list when already in sync
+	err = s.control().SendFileHashes(*uniqueFiles)
+	if err != nil {
+		return fmt.Errorf("unable to send file hashes: %w", prot.During("hash exchange", err))
+	}
+	s.files, s.bytes = len(*uniqueFiles), totalSize(*uniqueFiles)
+
+	// Receive confirmation, waiting on the peer's user
+	s.report("waiting for peer to accept %d files (%s)", s.files, status.FormatBytes(s.bytes))
+	decision, err := s.sock.ReceiveDecision(s.control())
+	if err != nil {
+		return fmt.Errorf("failed to receive confirmation: %w", prot.During("confirmation", err))
+	}
+	s.log.Debug("peer decided sync", "accepted", decision.Accepted, "reason", decision.Reason, "selected", len(decision.Files))
+	if err := decision.Err(); err != nil {
+		return err
+	}
+	s.accepted = true
+	*uniqueFiles, err = selectFiles(*uniqueFiles, decision.Files)
+	if err != nil {
+		return err
+	}
+	if decision.Files != nil {
+		s.files, s.bytes = len(*uniqueFiles), totalSize(*uniqueFiles)
+		s.printf("Peer accepted %d of the offered files\n", s.files)
+	}
+	s.synced = *uniqueFiles
+
+	s.filesSent(0, 0)
+	err = s.sendUniqueFiles(ctx, *uniqueFiles)
+	if err != nil {
+		return prot.During("file transfer", err)
+	}
+
+	// Wait until client has saved every file
+	var clientIsFinished bool
+	err = s.control().ReceiveEncryptedData(&clientIsFinished, prot.Bool)
+	if err != nil {
+		return fmt.Errorf("failed to receive confirmation: %w", prot.During("completion", err))
+	}
+	s.report("\033[32mdone\033[0m, sent %d files (%s)", s.files, status.FormatBytes(s.bytes))
+	return nil
+}
+
+// Tell the peer why a session failed before it is closed
+// Reports ctx's error when the session was canceled locally
+func (s *session) cancelOnError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, prot.ErrPeerCanceled) {
+		return err
+	}
+	if ctx.Err() != nil {
+		s.sock.SendCancel("sync canceled")
+		return ctx.Err()
+	}
+	s.sock.SendCancel(err.Error())
+	return err
+}
+
+// Receive file hashes from socket
+func (s *session) receiveUniqueHashes() ([]dir.FileHash, error) {
+	return s.control().ReceiveFileHashes()
+}
+
+// Sends unique hashes over client socket
+// Default to file hashes of every file in the directory
+func (s *session) sendUniqueHashes(uniqueHashes []dir.FileHash) error {
+	var err error
+	if uniqueHashes == nil {
+		// Keep the peer waiting patiently while large directories hash
+		stop := s.sock.StartHeartbeat(s.control())
+		uniqueHashes, err = s.c.DirMan.GetFileHashes(nil) // Empty slice will default to all files in directory
+		stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.control().SendFileHashes(uniqueHashes)
+}
+
+func (s *session) sendUniqueFiles(ctx context.Context, uniqueFiles []dir.FileHash) error {
+	if s.mux != nil {
+		return s.sendFileStreams(ctx, uniqueFiles)
+	}
+	if s.c.Parallel > 1 {
+		s.printf("Peer does not support multiplexing, sending files one at a time...\n")
+	}
+
+	s.useReporter(false)
+	var err error
+	for _, file := range uniqueFiles {
+		path := s.c.DirMan.Path + "/" + file.Name
+		err = s.sock.UploadFile(ctx, path)
+		if err != nil {
+			return fmt.Errorf("unable to upload %s: %w", file.Name, err)
+		}
+		s.filesSent(1, file.Size)
+	}
+
+	return nil
+}
+
+func (s *session) receiveUniqueFiles(ctx context.Context, uniqueHashes []dir.FileHash) error {
+	if s.mux != nil {
+		return s.receiveFileStreams(ctx, uniqueHashes)
+	}
+
+	s.useReporter(false)
+	for _, file := range uniqueHashes {
+		path, err := s.c.localPath(file.Name)
+		if err == nil {
+			unlock := s.c.locks.lock(path)
+			err = s.sock.DownloadFile(ctx, path)
+			if err == nil {
+				err = s.verifyReceived(file, path)
+			}
+			unlock()
+		}
+		if err != nil {
+			return fmt.Errorf("unable to download %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Check that the file written to path holds what the peer offered, and
+// record it as transferred
+// Caller holds the lock on path
+func (s *session) verifyReceived(file dir.FileHash, path string) error {
+	hash, err := dir.HashFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to verify %s: %w", file.Name, err)
+	}
+	if hash != file.Hash {
+		return fmt.Errorf("%s does not match the hash offered by the peer", file.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transferred == nil {
+		s.transferred = map[string]bool{}
+	}
+	s.transferred[file.Name] = true
+	return nil
+}
@@ -0,0 +1,314 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Unit of work for an upload worker: one large file or a batch of small ones
+type uploadJob struct {
+	desc string
+	run  func() error
+}
+
+// Upload files over streams with a pool of s.c.Parallel workers
+// Announces the parallelism first so the peer can pick its output style
+func (s *session) sendFileStreams(ctx context.Context, uniqueFiles []dir.FileHash) error {
+	workers := min(max(s.c.Parallel, 1), prot.MaxPendingStreams)
+	var parallelPkt prot.Packet
+	err := parallelPkt.SerializeToBody(int64(workers), prot.Int64)
+	if err != nil {
+		return err
+	}
+	err = s.control().SendEncryptedPacket(parallelPkt)
+	if err != nil {
+		return err
+	}
+	s.useReporter(workers > 1)
+
+	pending := s.uploadJobs(ctx, uniqueFiles)
+	jobs := make(chan uploadJob)
+	results := make(chan error, len(pending))
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		for _, job := range pending {
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for range workers {
+		go func() {
+			for job := range jobs {
+				err := job.run()
+				if err != nil {
+					err = fmt.Errorf("unable to upload %s: %w", job.desc, err)
+				}
+				results <- err
+			}
+		}()
+	}
+
+	for range pending {
+		if err := <-results; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Split files into upload jobs
+// Small files share one batch stream when the peer supports batching
+func (s *session) uploadJobs(ctx context.Context, files []dir.FileHash) []uploadJob {
+	var jobs []uploadJob
+	var batch []prot.BatchFile
+	batchSize := int64(0)
+	for _, file := range files {
+		path := s.c.DirMan.Path + "/" + file.Name
+		if s.sock.Supports(prot.CapBatch) && file.Size <= prot.BatchFileSize {
+			batch = append(batch, prot.BatchFile{Name: file.Name, Path: path})
+			batchSize += file.Size
+			continue
+		}
+
+		jobs = append(jobs, uploadJob{
+			desc: file.Name,
+			run: func() error {
+				err := s.sendFileStream(ctx, file.Name, path)
+				if err != nil {
+					return err
+				}
+				s.filesSent(1, file.Size)
+				return nil
+			},
+		})
+	}
+
+	// Send the batch first so many small files start moving at once
+	if len(batch) > 0 {
+		batchJob := uploadJob{
+			desc: fmt.Sprintf("batch of %d files", len(batch)),
+			run: func() error {
+				st, err := s.mux.OpenStream()
+				if err != nil {
+					return err
+				}
+				err = st.UploadBatch(ctx, batch)
+				if err != nil {
+					return err
+				}
+				s.filesSent(len(batch), batchSize)
+				return nil
+			},
+		}
+		jobs = append([]uploadJob{batchJob}, jobs...)
+	}
+
+	return jobs
+}
+
+// Upload file on its own stream, prefixed with its name
+func (s *session) sendFileStream(ctx context.Context, name string, path string) error {
+	st, err := s.mux.OpenStream()
+	if err != nil {
+		return err
+	}
+
+	var namePkt prot.Packet
+	err = namePkt.SerializeToBody(name, prot.FileName)
+	if err != nil {
+		return err
+	}
+	err = st.SendEncryptedPacket(namePkt)
+	if err != nil {
+		return err
+	}
+
+	err = st.UploadFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	return st.Close()
+}
+
+// Files received on one stream, or why the stream failed
+type streamResult struct {
+	files int
+	err   error
+}
+
+// Accept streams and download them concurrently until every file arrives
+// Streams carry one file or a batch, may arrive in any order, and may
+// only name each expected file once
+func (s *session) receiveFileStreams(ctx context.Context, uniqueHashes []dir.FileHash) error {
+	var parallel int64
+	err := s.control().ReceiveEncryptedData(&parallel, prot.Int64)
+	if err != nil {
+		return err
+	}
+	if parallel < 1 || parallel > prot.MaxPendingStreams {
+		return fmt.Errorf("peer announced invalid parallelism %d", parallel)
+	}
+	s.useReporter(parallel > 1)
+
+	var mu sync.Mutex
+	pending := make(map[string]dir.FileHash, len(uniqueHashes))
+	for _, file := range uniqueHashes {
+		pending[file.Name] = file
+	}
+	// Claim a file name so no two streams write the same file
+	claim := func(name string) (dir.FileHash, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		file, ok := pending[name]
+		delete(pending, name)
+		return file, ok
+	}
+
+	// At most one stream per file, plus an accept error
+	// Batches carry several files, so stop accepting once every file arrived
+	results := make(chan streamResult, len(uniqueHashes)+1)
+	acceptCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		for range uniqueHashes {
+			st, err := s.mux.AcceptStream(acceptCtx)
+			if err != nil {
+				if acceptCtx.Err() == nil {
+					results <- streamResult{err: err}
+				}
+				return
+			}
+			go func() {
+				n, err := s.receiveFileStream(ctx, st, claim)
+				results <- streamResult{files: n, err: err}
+			}()
+		}
+	}()
+
+	for received := 0; received < len(uniqueHashes); {
+		res := <-results
+		if res.err != nil {
+			return res.err
+		}
+		received += res.files
+	}
+
+	return nil
+}
+
+// Download the file or batch that st carries
+// Returns the number of files received
+func (s *session) receiveFileStream(ctx context.Context, st *prot.Stream, claim func(string) (dir.FileHash, bool)) (int, error) {
+	var first prot.Packet
+	err := st.ReceiveEncryptedPacket(&first)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	if first.Type == prot.BatchStart {
+		n, err = s.receiveBatch(ctx, st, first, claim)
+	} else {
+		err = s.receiveSingleFile(ctx, st, first, claim)
+		n = 1
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return n, st.Close()
+}
+
+func (s *session) receiveSingleFile(ctx context.Context, st *prot.Stream, first prot.Packet, claim func(string) (dir.FileHash, bool)) error {
+	if first.Type != prot.FileName {
+		return fmt.Errorf("%w: expected %d, received %d", prot.ErrPacketTypeMismatch, prot.FileName, first.Type)
+	}
+	var name string
+	err := first.DeserializeBody(&name)
+	if err != nil {
+		return err
+	}
+	file, ok := claim(name)
+	if !ok {
+		return fmt.Errorf("peer sent unexpected file %q", name)
+	}
+
+	path, err := s.c.localPath(name)
+	if err == nil {
+		unlock := s.c.locks.lock(path)
+		err = st.DownloadFile(ctx, path)
+		if err == nil {
+			err = s.verifyReceived(file, path)
+		}
+		unlock()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to download %s: %w", name, err)
+	}
+
+	// Wait for the sender to close its side before closing ours
+	var pkt prot.Packet
+	if err := st.ReceiveEncryptedPacket(&pkt); err != io.EOF {
+		return fmt.Errorf("expected end of stream for %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *session) receiveBatch(ctx context.Context, st *prot.Stream, first prot.Packet, claim func(string) (dir.FileHash, bool)) (int, error) {
+	// Records arrive one after another, so the previous record is written
+	// by the time the next is resolved and at most one lock is held
+	var prev dir.FileHash
+	prevPath := ""
+	unlock := func() {}
+	// Verify the previous record and release its lock
+	finish := func() error {
+		defer func() {
+			unlock()
+			unlock = func() {}
+			prevPath = ""
+		}()
+		if prevPath == "" {
+			return nil
+		}
+		return s.verifyReceived(prev, prevPath)
+	}
+	resolve := func(name string) (string, error) {
+		if err := finish(); err != nil {
+			return "", err
+		}
+		file, ok := claim(name)
+		if !ok {
+			return "", fmt.Errorf("peer sent unexpected file %q", name)
+		}
+		path, err := s.c.localPath(name)
+		if err != nil {
+			return "", err
+		}
+		unlock = s.c.locks.lock(path)
+		prev, prevPath = file, path
+		return path, nil
+	}
+
+	n, err := st.DownloadBatch(ctx, first, resolve)
+	if err != nil {
+		unlock()
+		return 0, fmt.Errorf("unable to download batch: %w", err)
+	}
+	if err := finish(); err != nil {
+		return 0, fmt.Errorf("unable to download batch: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/client"
+	"github.com/sebastian-j-ibanez/fsync/daemon"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Keep the folder in sync in the background",
+	Long: `Serves peers, pushes changes to registered peers and takes requests
+from the sync, listen and register commands run in the same folder.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Get flags
+		portFlag, _ := cmd.Flags().GetString("port")
+		scanFlag, _ := cmd.Flags().GetBool("scan")
+		intervalFlag, _ := cmd.Flags().GetDuration("interval")
+		watchFlag, _ := cmd.Flags().GetDuration("watch-interval")
+
+		// Handle port flag
+		port, err := strconv.Atoi(portFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot convert arg to port\n")
+			os.Exit(-1)
+		}
+		if port <= 0 {
+			fmt.Fprintf(os.Stderr, "error: port must be greater than 0\n")
+			os.Exit(-1)
+		}
+		if intervalFlag < 0 || watchFlag < 0 {
+			fmt.Fprintf(os.Stderr, "error: intervals must not be negative\n")
+			os.Exit(-1)
+		}
+
+		// Init dir manager
+		path, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		d, err := dir.NewDirManager(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		// Check client flags once, every sync gets a copy
+		template := client.Client{
+			DirMan:  *d,
+			History: historyFile(cmd, path),
+		}
+		compressFlag, _ := cmd.Flags().GetString("compress")
+		template.Compression, err = prot.ParseCompressionMode(compressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setBandwidthLimits(cmd, &template); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setTimeouts(cmd, &template); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setPolicy(cmd, &template); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		socketFlag := socketPath(cmd, path)
+		httpFlag, _ := cmd.Flags().GetString("http")
+
+		// Token for the HTTP API, kept next to the control socket
+		var token string
+		if httpFlag != "" {
+			token = os.Getenv("FSYNC_HTTP_TOKEN")
+			if token == "" {
+				tokenPath := socketFlag + ".token"
+				token, err = daemon.LoadToken(tokenPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error: unable to load HTTP token: %v\n", err)
+					os.Exit(-1)
+				}
+				fmt.Printf("HTTP API token in %s\n", tokenPath)
+			}
+		}
+
+		dm := daemon.Daemon{
+			NewClient: func() *client.Client {
+				return &client.Client{
+					DirMan:        template.DirMan,
+					MaxPeers:      4,
+					Parallel:      1,
+					Compression:   template.Compression,
+					UploadLimit:   template.UploadLimit,
+					DownloadLimit: template.DownloadLimit,
+					Timeouts:      template.Timeouts,
+					Policy:        template.Policy,
+					History:       template.History,
+				}
+			},
+			Port:          port,
+			SocketPath:    socketFlag,
+			Interval:      intervalFlag,
+			WatchInterval: watchFlag,
+			HTTPAddr:      httpFlag,
+			HTTPToken:     token,
+		}
+
+		// Broadcast MDNS service
+		endBroadcast := make(chan bool)
+		if scanFlag {
+			go func() {
+				if err := client.BroadcastMDNSService(port, endBroadcast); err != nil {
+					fmt.Fprintf(os.Stderr, "error: %s", err.Error())
+					os.Exit(-1)
+				}
+			}()
+		}
+
+		// Run until Ctrl-C or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = dm.Run(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		// End MDNS service broadcast
+		if scanFlag {
+			endBroadcast <- true
+		}
+
+		fmt.Println("Daemon stopped")
+	},
+}
+
+// Flags that keep working when the daemon does the work: how to reach it
+// and how this process reports
+var daemonLocalFlags = []string{"socket", "no-daemon", "output", "log-level", "log-file"}
+
+// Report flags set on cmd that the daemon would not honor
+// forwarded names the flags sent along with the request
+func checkDaemonFlags(cmd *cobra.Command, forwarded ...string) error {
+	var ignored []string
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if !slices.Contains(daemonLocalFlags, f.Name) && !slices.Contains(forwarded, f.Name) {
+			ignored = append(ignored, "--"+f.Name)
+		}
+	})
+	if len(ignored) > 0 {
+		return fmt.Errorf("the fsync daemon serving this folder does not support %s, pass --no-daemon to use them",
+			strings.Join(ignored, ", "))
+	}
+	return nil
+}
+
+// Status of the daemon serving the working directory, if one is running
+// and --no-daemon was not given
+func runningDaemon(cmd *cobra.Command) (daemon.Status, bool) {
+	noDaemon, _ := cmd.Flags().GetBool("no-daemon")
+	if noDaemon {
+		return daemon.Status{}, false
+	}
+	path, err := os.Getwd()
+	if err != nil {
+		return daemon.Status{}, false
+	}
+	return daemon.Find(socketPath(cmd, path), path)
+}
+
+// Send req to the running daemon, exiting on failure
+func callDaemon(ctx context.Context, cmd *cobra.Command, req daemon.Request) daemon.Response {
+	path, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(-1)
+	}
+	resp, err := daemon.Call(ctx, socketPath(cmd, path), req)
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "Sync canceled")
+		} else {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(-1)
+	}
+	return resp
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.PersistentFlags().BoolP("scan", "s", false, "advertise the daemon on the local network")
+	daemonCmd.PersistentFlags().StringP("port", "p", "8080", "specify the port")
+	daemonCmd.PersistentFlags().String("compress", "auto", "compress transfers: auto, always or never")
+	daemonCmd.PersistentFlags().Duration("interval", 0, "sync with registered peers this often, 0 to never")
+	daemonCmd.PersistentFlags().Duration("watch-interval", 2*time.Second, "check the folder for changes this often, 0 to never")
+	daemonCmd.PersistentFlags().String("http", "", "serve the HTTP API on this localhost address, e.g. 127.0.0.1:8081")
+	addBandwidthFlags(daemonCmd)
+	addTimeoutFlags(daemonCmd)
+	addPolicyFlags(daemonCmd)
+}
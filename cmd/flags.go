@@ -0,0 +1,137 @@
+/*
+Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/client"
+	"github.com/sebastian-j-ibanez/fsync/daemon"
+	"github.com/sebastian-j-ibanez/fsync/history"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/spf13/cobra"
+)
+
+const scheduleHelp = "RATE[,HH:MM-HH:MM=RATE...], e.g. 2M,22:00-07:00=off"
+
+// Register bandwidth limit flags on a command
+func addBandwidthFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("bwlimit", "", "limit upload and download bandwidth: "+scheduleHelp)
+	cmd.PersistentFlags().String("bwlimit-up", "", "limit upload bandwidth, overrides --bwlimit")
+	cmd.PersistentFlags().String("bwlimit-down", "", "limit download bandwidth, overrides --bwlimit")
+}
+
+// Apply bandwidth limit flags to client
+func setBandwidthLimits(cmd *cobra.Command, c *client.Client) error {
+	both, _ := cmd.Flags().GetString("bwlimit")
+	upFlag, _ := cmd.Flags().GetString("bwlimit-up")
+	downFlag, _ := cmd.Flags().GetString("bwlimit-down")
+	if upFlag == "" {
+		upFlag = both
+	}
+	if downFlag == "" {
+		downFlag = both
+	}
+
+	var err error
+	c.UploadLimit, err = prot.ParseSchedule(upFlag)
+	if err != nil {
+		return err
+	}
+	c.DownloadLimit, err = prot.ParseSchedule(downFlag)
+	return err
+}
+
+// Register connection timeout flags shared by every command that syncs
+func addTimeoutFlags(cmd *cobra.Command) {
+	def := prot.DefaultTimeouts()
+	cmd.PersistentFlags().Duration("handshake-timeout", def.Handshake, "time allowed to set up an encrypted session, 0 to wait forever")
+	cmd.PersistentFlags().Duration("packet-timeout", def.Packet, "time a silent peer is allowed before it is considered dead, 0 to wait forever")
+}
+
+// Apply timeout flags to client
+// Flags a command does not define keep their defaults
+func setTimeouts(cmd *cobra.Command, c *client.Client) error {
+	t := prot.DefaultTimeouts()
+	flags := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"connect-timeout", &t.Dial},
+		{"handshake-timeout", &t.Handshake},
+		{"idle-timeout", &t.Idle},
+		{"packet-timeout", &t.Packet},
+		{"prompt-timeout", &t.Prompt},
+	}
+	for _, f := range flags {
+		if cmd.Flags().Lookup(f.name) == nil {
+			continue
+		}
+		d, err := cmd.Flags().GetDuration(f.name)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("--%s must not be negative", f.name)
+		}
+		*f.dst = d
+	}
+
+	// Assume the peer waits about as long as we do between packets
+	if t.Packet > 0 {
+		t.Heartbeat = min(t.Heartbeat, t.Packet/4)
+	}
+	c.Timeouts = &t
+	return nil
+}
+
+// Register flags deciding incoming syncs without a prompt
+func addPolicyFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolP("yes", "y", false, "accept every incoming sync without asking")
+	cmd.PersistentFlags().StringSlice("auto-accept-from", nil, "accept syncs from these peers without asking, by IP or IP:PORT")
+	cmd.PersistentFlags().String("policy", "", "JSON file of rules deciding incoming syncs without asking")
+}
+
+// Apply policy flags to client
+// Flags are merged into the policy file when both are given
+func setPolicy(cmd *cobra.Command, c *client.Client) error {
+	yesFlag, _ := cmd.Flags().GetBool("yes")
+	fromFlag, _ := cmd.Flags().GetStringSlice("auto-accept-from")
+	policyFlag, _ := cmd.Flags().GetString("policy")
+
+	policy := &client.Policy{}
+	if policyFlag != "" {
+		var err error
+		policy, err = client.LoadPolicy(policyFlag)
+		if err != nil {
+			return err
+		}
+	} else if !yesFlag && len(fromFlag) == 0 {
+		return nil
+	}
+	policy.AcceptAll = policy.AcceptAll || yesFlag
+	policy.AutoAcceptFrom = append(policy.AutoAcceptFrom, fromFlag...)
+	if err := policy.Check(); err != nil {
+		return err
+	}
+	c.Policy = policy
+	return nil
+}
+
+// History file of the folder at dir, from --history-file or the default
+func historyFile(cmd *cobra.Command, dir string) string {
+	if path, _ := cmd.Flags().GetString("history-file"); path != "" {
+		return path
+	}
+	return history.DefaultPath(dir)
+}
+
+// Control socket given by --socket, or the default one of the daemon serving dir
+func socketPath(cmd *cobra.Command, dir string) string {
+	if path, _ := cmd.Flags().GetString("socket"); path != "" {
+		return path
+	}
+	return daemon.DefaultSocketPath(dir)
+}
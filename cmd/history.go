@@ -0,0 +1,133 @@
+/*
+Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/history"
+	"github.com/sebastian-j-ibanez/fsync/status"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "show past syncs of this folder",
+	Long: `Show the syncs of this folder with any peer, oldest first.
+Every session records its peer, direction, the files transferred with their
+sizes and hashes, how long it took and how it ended.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		var f history.Filter
+		f.Peer, _ = cmd.Flags().GetString("peer")
+		f.Direction, _ = cmd.Flags().GetString("direction")
+		f.Result, _ = cmd.Flags().GetString("result")
+		f.File, _ = cmd.Flags().GetString("file")
+		f.Hash, _ = cmd.Flags().GetString("hash")
+		sinceFlag, _ := cmd.Flags().GetString("since")
+		limitFlag, _ := cmd.Flags().GetInt("limit")
+		filesFlag, _ := cmd.Flags().GetBool("files")
+
+		switch f.Direction {
+		case "", "send", "receive":
+		default:
+			fmt.Fprintf(os.Stderr, "error: invalid direction %q, expected send or receive\n", f.Direction)
+			os.Exit(-1)
+		}
+		switch f.Result {
+		case "", history.ResultCompleted, history.ResultFailed, history.ResultCanceled, history.ResultRejected:
+		default:
+			fmt.Fprintf(os.Stderr, "error: invalid result %q, expected completed, failed, canceled or rejected\n", f.Result)
+			os.Exit(-1)
+		}
+		if sinceFlag != "" {
+			f.Since, err = history.ParseSince(sinceFlag, time.Now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(-1)
+			}
+		}
+		if limitFlag < 0 {
+			fmt.Fprintf(os.Stderr, "error: limit must not be negative\n")
+			os.Exit(-1)
+		}
+
+		entries, err := history.Read(historyFile(cmd, path))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		var matched []history.Entry
+		for _, e := range entries {
+			if f.Match(e) {
+				matched = append(matched, e)
+			}
+		}
+		// Keep the most recent entries
+		if limitFlag > 0 && len(matched) > limitFlag {
+			matched = matched[len(matched)-limitFlag:]
+		}
+
+		if status.EventsEnabled() {
+			enc := json.NewEncoder(eventOut)
+			for _, e := range matched {
+				enc.Encode(e)
+			}
+			return
+		}
+		if len(matched) == 0 {
+			fmt.Println("No syncs recorded")
+			return
+		}
+		for _, e := range matched {
+			printEntry(e)
+			// Show files when asked for, or the ones a filter looked for
+			files := e.Files
+			if f.File != "" || f.Hash != "" {
+				files = f.Files(e)
+			} else if !filesFlag {
+				continue
+			}
+			for _, file := range files {
+				fmt.Printf("    %s  %s  %s\n", file.Name, status.FormatBytes(file.Size), file.Hash)
+			}
+		}
+	},
+}
+
+// Print one line summing up e
+func printEntry(e history.Entry) {
+	peer := e.Peer
+	if e.Hostname != "" {
+		peer = e.Hostname + " (" + e.Peer + ")"
+	}
+	result := e.Result
+	if e.Error != "" {
+		result += ": " + e.Error
+	}
+	duration := time.Duration(e.Duration * float64(time.Second)).Round(time.Millisecond)
+	fmt.Printf("%s  %-7s  %s  %d files  %s  in %s  %s\n", e.Time.Local().Format(time.DateTime),
+		e.Direction, peer, len(e.Files), status.FormatBytes(e.Bytes), duration, result)
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.PersistentFlags().String("peer", "", "only syncs with this peer, by address, IP or hostname")
+	historyCmd.PersistentFlags().String("direction", "", "only syncs in this direction: send or receive")
+	historyCmd.PersistentFlags().String("result", "", "only syncs that ended this way: completed, failed, canceled or rejected")
+	historyCmd.PersistentFlags().String("file", "", "only syncs that transferred a file matching this name or glob")
+	historyCmd.PersistentFlags().String("hash", "", "only syncs that transferred a file whose hash starts with this")
+	historyCmd.PersistentFlags().String("since", "", "only syncs since this time: a duration like 72h, a date or an RFC 3339 time")
+	historyCmd.PersistentFlags().IntP("limit", "n", 0, "show only the most recent n syncs, 0 for all")
+	historyCmd.PersistentFlags().Bool("files", false, "list the files of each sync")
+}
@@ -4,12 +4,19 @@ Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/sebastian-j-ibanez/fsync/client"
+	"github.com/sebastian-j-ibanez/fsync/daemon"
 	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +29,7 @@ var listenCmd = &cobra.Command{
 		// Get flags
 		portFlag, _ := cmd.Flags().GetString("port")
 		scanFlag, _ := cmd.Flags().GetBool("scan")
+		dryRunFlag, _ := cmd.Flags().GetBool("dry-run")
 
 		// Handle port flag
 		port := 8080
@@ -38,6 +46,21 @@ var listenCmd = &cobra.Command{
 			}
 		}
 
+		// The daemon serving this folder already listens, wait for its next sync
+		// Dry runs and event streams need the work done in this process
+		if st, ok := runningDaemon(cmd); ok && !dryRunFlag && !status.EventsEnabled() {
+			if err := checkDaemonFlags(cmd, "dry-run"); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(-1)
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			fmt.Printf("Waiting for a sync through the fsync daemon on port %d...\n", st.Port)
+			resp := callDaemon(ctx, cmd, daemon.Request{Command: daemon.CommandListen})
+			fmt.Printf("Sync with %s completed successfully!\n", resp.Peer)
+			return
+		}
+
 		// Broadcast MDNS service
 		endBroadcast := make(chan bool)
 		if scanFlag {
@@ -64,11 +87,44 @@ var listenCmd = &cobra.Command{
 
 		// Init client
 		c := client.Client{
-			DirMan: *d,
+			DirMan:  *d,
+			DryRun:  dryRunFlag,
+			History: historyFile(cmd, path),
+		}
+		compressFlag, _ := cmd.Flags().GetString("compress")
+		c.Compression, err = prot.ParseCompressionMode(compressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		progressFlag, _ := cmd.Flags().GetString("progress")
+		c.Progress, err = status.ParseProgressStyle(progressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setBandwidthLimits(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setTimeouts(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setPolicy(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
 		}
 
 		// Await sync
-		err = c.AwaitSync(port)
+		// Cancel gracefully on Ctrl-C or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = c.AwaitSync(ctx, port)
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "Sync canceled")
+			os.Exit(-1)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(-1)
@@ -79,7 +135,9 @@ var listenCmd = &cobra.Command{
 			endBroadcast <- true
 		}
 
-		fmt.Printf("Sync completed successfully!\n")
+		if !dryRunFlag {
+			fmt.Printf("Sync completed successfully!\n")
+		}
 	},
 }
 
@@ -87,4 +145,11 @@ func init() {
 	rootCmd.AddCommand(listenCmd)
 	listenCmd.PersistentFlags().BoolP("scan", "s", false, "scan network for peer")
 	listenCmd.PersistentFlags().StringP("port", "p", "8080", "specify the port")
+	listenCmd.PersistentFlags().Bool("dry-run", false, "show what a sync would write, then cancel it")
+	listenCmd.PersistentFlags().String("compress", "auto", "compress transfers: auto, always or never")
+	listenCmd.PersistentFlags().String("progress", "auto", "show progress: auto, bar, log, total or none")
+	addBandwidthFlags(listenCmd)
+	listenCmd.PersistentFlags().Duration("idle-timeout", 0, "stop listening if no peer connects in time, 0 to wait forever")
+	addTimeoutFlags(listenCmd)
+	addPolicyFlags(listenCmd)
 }
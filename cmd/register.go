@@ -4,11 +4,13 @@ Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 
+	"github.com/sebastian-j-ibanez/fsync/daemon"
 	prot "github.com/sebastian-j-ibanez/fsync/protocol"
 	"github.com/spf13/cobra"
 )
@@ -18,7 +20,8 @@ var registerCmd = &cobra.Command{
 	Use:   "register",
 	Short: "register a peer",
 	Long: `Start process to register a peer client.
-	Program will ask for IP and then port.`,
+	Program will ask for IP and then port.
+	Registering an address again replaces its entry, e.g. to change its bandwidth limits.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var ip string
 		var port string
@@ -46,6 +49,21 @@ var registerCmd = &cobra.Command{
 			IP:   ip,
 			Port: port,
 		}
+		peer.BwLimitUp, _ = cmd.Flags().GetString("bwlimit-up")
+		peer.BwLimitDown, _ = cmd.Flags().GetString("bwlimit-down")
+		for _, limit := range []string{peer.BwLimitUp, peer.BwLimitDown} {
+			if _, err := prot.ParseSchedule(limit); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(-1)
+			}
+		}
+
+		// Keep the daemon's view of the peer store current
+		if _, ok := runningDaemon(cmd); ok {
+			callDaemon(context.Background(), cmd, daemon.Request{Command: daemon.CommandRegister, Peer: &peer})
+			return
+		}
+
 		err := prot.RegisterPeer(peer)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: unable to register peer\n")
@@ -56,4 +74,6 @@ var registerCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(registerCmd)
+	registerCmd.PersistentFlags().String("bwlimit-up", "", "limit upload bandwidth to this peer: "+scheduleHelp)
+	registerCmd.PersistentFlags().String("bwlimit-down", "", "limit download bandwidth from this peer: "+scheduleHelp)
 }
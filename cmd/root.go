@@ -4,19 +4,50 @@ Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
 package cmd
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/sebastian-j-ibanez/fsync/logging"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
 	"github.com/spf13/cobra"
 )
 
+// Stdout before --output json moves messages to stderr
+var eventOut = os.Stdout
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "fsync",
-	Short: "A P2P file syncing program",
-	Long:  `fsync is a P2P file syncing program.`,
+	Use:     "fsync",
+	Short:   "A P2P file syncing program",
+	Long:    `fsync is a P2P file syncing program.`,
+	Version: prot.SoftwareVersion,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//Run: func(cmd *cobra.Command, args []string) {},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		levelFlag, _ := cmd.Flags().GetString("log-level")
+		level, err := logging.ParseLevel(levelFlag)
+		if err != nil {
+			return err
+		}
+		logFileFlag, _ := cmd.Flags().GetString("log-file")
+		if err := logging.Setup(level, logFileFlag); err != nil {
+			return err
+		}
+
+		outputFlag, _ := cmd.Flags().GetString("output")
+		switch outputFlag {
+		case "text":
+		case "json":
+			// Stdout carries only events, everything else goes to stderr
+			status.EmitEvents(os.Stdout)
+			os.Stdout = os.Stderr
+		default:
+			return fmt.Errorf("invalid output format %q, expected text or json", outputFlag)
+		}
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -29,5 +60,10 @@ func Execute() {
 }
 
 func init() {
-
+	rootCmd.PersistentFlags().Bool("no-daemon", false, "do the work in this process even if a daemon is running")
+	rootCmd.PersistentFlags().String("socket", "", "control socket of the fsync daemon (default one per folder in the user's runtime directory)")
+	rootCmd.PersistentFlags().StringP("output", "o", "text", "output format: text, or json for newline-delimited events on stdout")
+	rootCmd.PersistentFlags().String("log-level", "warn", "log level: trace, debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-file", "", "append logs to this file instead of stderr")
+	rootCmd.PersistentFlags().String("history-file", "", "sync history of this folder (default under $XDG_STATE_HOME/fsync/history)")
 }
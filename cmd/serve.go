@@ -0,0 +1,123 @@
+/*
+Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve sync requests from many peers",
+	Long: `Accepts sync requests from any number of peers at once until interrupted.
+Each peer is handled over its own session. Files are written one writer at a time.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Get flags
+		portFlag, _ := cmd.Flags().GetString("port")
+		scanFlag, _ := cmd.Flags().GetBool("scan")
+
+		// Handle port flag
+		port, err := strconv.Atoi(portFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot convert arg to port\n")
+			os.Exit(-1)
+		}
+		if port <= 0 {
+			fmt.Fprintf(os.Stderr, "error: port must be greater than 0\n")
+			os.Exit(-1)
+		}
+
+		// Init dir manager
+		path, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		d, err := dir.NewDirManager(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		// Init client
+		c := client.Client{
+			DirMan:  *d,
+			History: historyFile(cmd, path),
+		}
+		compressFlag, _ := cmd.Flags().GetString("compress")
+		c.Compression, err = prot.ParseCompressionMode(compressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		progressFlag, _ := cmd.Flags().GetString("progress")
+		c.Progress, err = status.ParseProgressStyle(progressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setBandwidthLimits(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setTimeouts(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setPolicy(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		// Broadcast MDNS service
+		endBroadcast := make(chan bool)
+		if scanFlag {
+			go func() {
+				if err := client.BroadcastMDNSService(port, endBroadcast); err != nil {
+					fmt.Fprintf(os.Stderr, "error: %s", err.Error())
+					os.Exit(-1)
+				}
+			}()
+		}
+
+		// Serve until Ctrl-C or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = c.Serve(ctx, port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+
+		// End MDNS service broadcast
+		if scanFlag {
+			endBroadcast <- true
+		}
+
+		fmt.Println("Server stopped")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.PersistentFlags().BoolP("scan", "s", false, "advertise the server on the local network")
+	serveCmd.PersistentFlags().StringP("port", "p", "8080", "specify the port")
+	serveCmd.PersistentFlags().String("compress", "auto", "compress transfers: auto, always or never")
+	serveCmd.PersistentFlags().String("progress", "auto", "show progress: auto, bar, log, total or none")
+	addBandwidthFlags(serveCmd)
+	addTimeoutFlags(serveCmd)
+	addPolicyFlags(serveCmd)
+}
@@ -4,13 +4,19 @@ Copyright © 2024 Sebastian Ibanez <sebas.ibanez219@gmail.com>
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sebastian-j-ibanez/fsync/client"
+	"github.com/sebastian-j-ibanez/fsync/daemon"
 	dir "github.com/sebastian-j-ibanez/fsync/directory"
 	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
 	"github.com/spf13/cobra"
 )
 
@@ -33,11 +39,57 @@ Uses list of peers unless port flag is specified.`,
 			os.Exit(-1)
 		}
 		c := client.Client{
-			DirMan: *d,
+			DirMan:  *d,
+			History: historyFile(cmd, path),
 		}
 
 		addrFlag, _ := cmd.Flags().GetString("address")
-		peersFlag, _ := cmd.Flags().GetString("peers")
+		peersFlag, _ := cmd.Flags().GetBool("peers")
+		parallelFlag, _ := cmd.Flags().GetInt("parallel")
+
+		if parallelFlag < 1 || parallelFlag > prot.MaxPendingStreams {
+			fmt.Fprintf(os.Stderr, "error: parallel must be between 1 and %d\n", prot.MaxPendingStreams)
+			os.Exit(-1)
+		}
+		c.Parallel = parallelFlag
+		c.DryRun, _ = cmd.Flags().GetBool("dry-run")
+
+		maxPeersFlag, _ := cmd.Flags().GetInt("max-peers")
+		if maxPeersFlag < 1 {
+			fmt.Fprintf(os.Stderr, "error: max-peers must be at least 1\n")
+			os.Exit(-1)
+		}
+		c.MaxPeers = maxPeersFlag
+
+		retriesFlag, _ := cmd.Flags().GetInt("retries")
+		if retriesFlag < 0 {
+			fmt.Fprintf(os.Stderr, "error: retries must not be negative\n")
+			os.Exit(-1)
+		}
+		retry := client.DefaultRetryPolicy()
+		retry.Retries = retriesFlag
+		c.Retry = &retry
+
+		compressFlag, _ := cmd.Flags().GetString("compress")
+		c.Compression, err = prot.ParseCompressionMode(compressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		progressFlag, _ := cmd.Flags().GetString("progress")
+		c.Progress, err = status.ParseProgressStyle(progressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setBandwidthLimits(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
+		if err := setTimeouts(cmd, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(-1)
+		}
 
 		// Flag cases:
 		// 1. Peer flag (use specific ip)
@@ -54,7 +106,7 @@ Uses list of peers unless port flag is specified.`,
 				os.Exit(-1)
 			}
 			c.Peers = []prot.Peer{peer}
-		} else if peersFlag != "" {
+		} else if peersFlag {
 			c.Peers, err = prot.GetPeers()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error: unable to get peers: %v\n", err)
@@ -76,13 +128,41 @@ Uses list of peers unless port flag is specified.`,
 			filePattern = args
 		}
 
-		err = c.InitSync(filePattern)
+		// Cancel gracefully on Ctrl-C or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// Let the daemon serving this folder do the work
+		// Dry runs and event streams need the work done in this process
+		if st, ok := runningDaemon(cmd); ok && !c.DryRun && !status.EventsEnabled() {
+			if err := checkDaemonFlags(cmd, "address", "peers", "scan", "parallel", "dry-run"); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(-1)
+			}
+			fmt.Printf("Syncing through the fsync daemon (pid %d)...\n", st.PID)
+			callDaemon(ctx, cmd, daemon.Request{
+				Command:  daemon.CommandSync,
+				Peers:    c.Peers,
+				Files:    filePattern,
+				Parallel: c.Parallel,
+			})
+			fmt.Println("Sync completed successfully!")
+			return
+		}
+
+		err = c.InitSync(ctx, filePattern)
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "Sync canceled")
+			os.Exit(-1)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(-1)
 		}
 
-		fmt.Println("Sync completed successfully!")
+		if !c.DryRun {
+			fmt.Println("Sync completed successfully!")
+		}
 	},
 }
 
@@ -91,5 +171,15 @@ func init() {
 	syncCmd.PersistentFlags().BoolP("scan", "s", false, "scan network for peer and sync")
 	syncCmd.PersistentFlags().StringP("address", "a", "", "sync with specific IP:PORT")
 	syncCmd.PersistentFlags().BoolP("peers", "p", false, "sync with registered peers")
+	syncCmd.PersistentFlags().IntP("parallel", "j", 1, "number of files to transfer at once")
+	syncCmd.PersistentFlags().Int("max-peers", 4, "number of peers to sync with at once")
+	syncCmd.PersistentFlags().Int("retries", client.DefaultRetryPolicy().Retries, "times to retry a peer after a transient error")
+	syncCmd.PersistentFlags().Bool("dry-run", false, "show what would be sent without transferring anything")
+	syncCmd.PersistentFlags().String("compress", "auto", "compress transfers: auto, always or never")
+	syncCmd.PersistentFlags().String("progress", "auto", "show progress: auto, bar, log, total or none")
+	addBandwidthFlags(syncCmd)
+	syncCmd.PersistentFlags().Duration("connect-timeout", prot.DefaultTimeouts().Dial, "time allowed to connect to a peer, 0 to wait forever")
+	syncCmd.PersistentFlags().Duration("prompt-timeout", prot.DefaultTimeouts().Prompt, "time allowed for the peer to accept the sync, 0 to wait forever")
+	addTimeoutFlags(syncCmd)
 	syncCmd.MarkFlagsMutuallyExclusive("address", "scan", "peers")
 }
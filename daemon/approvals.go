@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+var errNoApproval = errors.New("no such pending approval")
+
+// Incoming sync waiting for a decision in the web UI
+type PendingApproval struct {
+	ID       int       `json:"id"`
+	Received time.Time `json:"received"`
+	client.Approval
+
+	decide chan prot.Decision
+}
+
+// Wait for the web UI to accept or reject a, or for ctx to be done
+func (d *Daemon) approve(ctx context.Context, a client.Approval) (prot.Decision, error) {
+	d.approvalsMu.Lock()
+	d.nextApproval++
+	p := &PendingApproval{
+		ID:       d.nextApproval,
+		Received: time.Now(),
+		Approval: a,
+		decide:   make(chan prot.Decision, 1),
+	}
+	d.approvals[p.ID] = p
+	d.approvalsMu.Unlock()
+
+	defer func() {
+		d.approvalsMu.Lock()
+		delete(d.approvals, p.ID)
+		d.approvalsMu.Unlock()
+	}()
+
+	fmt.Printf("Sync from %s (%s) waiting for approval in the web UI\n", a.Peer, a.Addr)
+	select {
+	case decision := <-p.decide:
+		return decision, nil
+	case <-ctx.Done():
+		return prot.Decision{}, ctx.Err()
+	}
+}
+
+// Answer pending approval id
+// Accepting only some files needs a peer supporting selection
+func (d *Daemon) decide(id int, decision prot.Decision) error {
+	d.approvalsMu.Lock()
+	defer d.approvalsMu.Unlock()
+	p, ok := d.approvals[id]
+	if !ok {
+		return errNoApproval
+	}
+	if decision.Files != nil {
+		if !p.Selectable {
+			return errors.New("peer can only send all files or none")
+		}
+		if len(decision.Files) == 0 {
+			return errors.New("no files selected")
+		}
+		for _, name := range decision.Files {
+			if !slices.ContainsFunc(p.Files, func(f dir.FileHash) bool { return f.Name == name }) {
+				return fmt.Errorf("%q was not offered", name)
+			}
+		}
+	}
+	delete(d.approvals, id)
+	p.decide <- decision
+	return nil
+}
+
+// Syncs waiting for a decision, oldest first
+func (d *Daemon) pendingApprovals() []PendingApproval {
+	d.approvalsMu.Lock()
+	defer d.approvalsMu.Unlock()
+	list := make([]PendingApproval, 0, len(d.approvals))
+	for _, p := range d.approvals {
+		list = append(list, *p)
+	}
+	slices.SortFunc(list, func(a, b PendingApproval) int { return a.ID - b.ID })
+	return list
+}
@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Control commands understood by the daemon
+const (
+	CommandStatus   = "status"
+	CommandSync     = "sync"
+	CommandListen   = "listen"
+	CommandRegister = "register"
+)
+
+// How long to wait for a status reply before assuming no daemon runs
+const probeTimeout = time.Second
+
+var ErrNotRunning = errors.New("fsync daemon is not running")
+
+// One request over the control socket, answered by one Response
+type Request struct {
+	Command string `json:"command"`
+	// Peers and file patterns to sync, registered peers when empty
+	Peers    []prot.Peer `json:"peers,omitempty"`
+	Files    []string    `json:"files,omitempty"`
+	Parallel int         `json:"parallel,omitempty"`
+	// Peer to register
+	Peer *prot.Peer `json:"peer,omitempty"`
+}
+
+type Response struct {
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+	// Address of the peer a listen request was served
+	Peer string `json:"peer,omitempty"`
+}
+
+// What a running daemon is doing
+type Status struct {
+	Dir     string    `json:"dir"`
+	Port    int       `json:"port"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Peers   int       `json:"peers"`
+}
+
+// Control socket of the daemon serving dir when none is given
+// Lives in the user's runtime directory, or a private per-user directory
+// in the temp dir, named after dir so each folder can have its own daemon
+func DefaultSocketPath(dir string) string {
+	sum := sha256.Sum256([]byte(dir))
+	name := "fsync-" + hex.EncodeToString(sum[:8]) + ".sock"
+	if runtime := os.Getenv("XDG_RUNTIME_DIR"); runtime != "" {
+		return filepath.Join(runtime, name)
+	}
+	return filepath.Join(os.TempDir(), "fsync-"+strconv.Itoa(os.Getuid()), name)
+}
+
+// Report a socket directory other users could plant a socket in
+// The directory must be a real directory owned by this user and not
+// writable by anyone else
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if !ownedByUser(info) || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("socket directory %s is writable by other users", dir)
+	}
+	return nil
+}
+
+// Send req to the daemon listening on path and wait for its reply
+// Closing the connection when ctx is done cancels the request in the daemon
+func Call(ctx context.Context, path string, req Request) (Response, error) {
+	// Never talk to a socket another user could have put there
+	if err := checkSocketDir(filepath.Dir(path)); err != nil {
+		return Response{}, fmt.Errorf("%w: %w", ErrNotRunning, err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return Response{}, fmt.Errorf("%w: %w", ErrNotRunning, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return Response{}, fmt.Errorf("unable to send request to daemon: %w", err)
+	}
+
+	var resp Response
+	err = json.NewDecoder(conn).Decode(&resp)
+	if ctx.Err() != nil {
+		return Response{}, ctx.Err()
+	}
+	if err != nil {
+		return Response{}, fmt.Errorf("unable to read reply from daemon: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Status of the daemon on path if it is running and serves dir
+func Find(path, dir string) (Status, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	resp, err := Call(ctx, path, Request{Command: CommandStatus})
+	if err != nil || resp.Status == nil || resp.Status.Dir != dir {
+		return Status{}, false
+	}
+	return *resp.Status, true
+}
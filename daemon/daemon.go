@@ -0,0 +1,321 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/client"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Long-running fsync for one folder
+// Serves peers, pushes changes to registered peers and takes requests
+// from the sync, listen and register commands over a Unix socket
+type Daemon struct {
+	// Builds a client configured for the folder, once per sync
+	NewClient func() *client.Client
+	// Port to serve peers on
+	Port int
+	// Control socket, DefaultSocketPath when empty
+	SocketPath string
+	// Push to registered peers this often, 0 to never
+	Interval time.Duration
+	// Poll the folder for changes this often, 0 to never
+	WatchInterval time.Duration
+	// Serve the HTTP API on this loopback address when set
+	HTTPAddr string
+	// Bearer token every HTTP request must carry
+	HTTPToken string
+
+	dir     string
+	started time.Time
+	// One push at a time, so watcher, scheduler and requests don't race
+	pushMu sync.Mutex
+	// Listen requests waiting for the next served sync
+	waitMu  sync.Mutex
+	waiters []chan served
+	// Running and finished syncs
+	jobsMu  sync.Mutex
+	nextJob int
+	jobs    map[int]*Job
+	history []Job
+	// Files in flight across every sync
+	transfers *status.Transfers
+	// Incoming syncs waiting for the web UI
+	approvalsMu  sync.Mutex
+	nextApproval int
+	approvals    map[int]*PendingApproval
+}
+
+// Result of a sync served to a peer
+type served struct {
+	addr string
+	err  error
+}
+
+// Run the daemon until ctx is done or serving peers fails
+func (d *Daemon) Run(ctx context.Context) error {
+	d.jobs = make(map[int]*Job)
+	d.transfers = status.NewTransfers()
+	d.approvals = make(map[int]*PendingApproval)
+	server := d.newClient()
+	d.dir = server.DirMan.Path
+	if d.SocketPath == "" {
+		d.SocketPath = DefaultSocketPath(d.dir)
+	}
+	d.started = time.Now()
+	server.OnServed = d.notifyServed
+	// Incoming syncs are approved in the web UI when it is served
+	if d.HTTPAddr != "" {
+		server.Approve = d.approve
+	}
+
+	lis, err := listenControl(d.SocketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(d.SocketPath)
+	defer lis.Close()
+
+	var httpLis net.Listener
+	if d.HTTPAddr != "" {
+		httpLis, err = listenHTTP(d.HTTPAddr, d.HTTPToken)
+		if err != nil {
+			return err
+		}
+		defer httpLis.Close()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopAccept := context.AfterFunc(ctx, func() { lis.Close() })
+	defer stopAccept()
+
+	var wg sync.WaitGroup
+	run := func(f func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(ctx)
+		}()
+	}
+
+	var serveErr error
+	run(func(ctx context.Context) {
+		serveErr = server.Serve(ctx, d.Port)
+		// The daemon is of no use without its listener
+		cancel()
+	})
+	if d.WatchInterval > 0 {
+		run(d.watch)
+	}
+	if d.Interval > 0 {
+		run(d.schedule)
+	}
+	if httpLis != nil {
+		run(func(ctx context.Context) { d.serveHTTP(ctx, httpLis) })
+		fmt.Printf("Web UI and HTTP API at http://%s\n", httpLis.Addr())
+	}
+	fmt.Printf("Daemon control socket at %s\n", d.SocketPath)
+	d.serveControl(ctx, lis)
+
+	cancel()
+	wg.Wait()
+	return serveErr
+}
+
+// Listen on the control socket at path
+// The socket's directory is created private to this user when missing,
+// and must not be writable by anyone else
+// Replaces the socket of a daemon that exited without cleaning up
+func listenControl(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create socket directory: %w", err)
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already running on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Handle control connections until lis is closed
+func (d *Daemon) serveControl(ctx context.Context, lis net.Listener) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "error: unable to accept control connection: %v\n", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.handleControl(ctx, conn)
+		}()
+	}
+}
+
+// Answer one request, canceling it if the caller hangs up
+func (d *Daemon) handleControl(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	dec := json.NewDecoder(conn)
+	err := dec.Decode(&req)
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// Callers send nothing after the request, so this returns on hang up
+		io.Copy(io.Discard, dec.Buffered())
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	resp := d.dispatch(ctx, req)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (d *Daemon) dispatch(ctx context.Context, req Request) Response {
+	switch req.Command {
+	case CommandStatus:
+		st, err := d.status()
+		if err != nil {
+			return Response{Error: err.Error()}
+		}
+		return Response{Status: &st}
+	case CommandSync:
+		if len(req.Peers) == 0 {
+			peers, err := prot.GetPeers()
+			if err != nil {
+				return Response{Error: fmt.Sprintf("unable to get peers: %v", err)}
+			}
+			req.Peers = peers
+		}
+		if len(req.Peers) == 0 {
+			return Response{Error: "no peers to sync with"}
+		}
+		if err := d.runSync(ctx, req); err != nil {
+			return Response{Error: err.Error()}
+		}
+		return Response{}
+	case CommandListen:
+		res, err := d.awaitServed(ctx)
+		if err != nil {
+			return Response{Error: err.Error()}
+		}
+		if res.err != nil {
+			return Response{Error: res.err.Error(), Peer: res.addr}
+		}
+		return Response{Peer: res.addr}
+	case CommandRegister:
+		if req.Peer == nil {
+			return Response{Error: "no peer to register"}
+		}
+		if err := prot.RegisterPeer(*req.Peer); err != nil {
+			return Response{Error: fmt.Sprintf("unable to register peer: %v", err)}
+		}
+		return Response{}
+	default:
+		return Response{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+}
+
+func (d *Daemon) status() (Status, error) {
+	peers, err := prot.GetPeers()
+	if err != nil {
+		return Status{}, fmt.Errorf("unable to get peers: %w", err)
+	}
+	return Status{
+		Dir:     d.dir,
+		Port:    d.Port,
+		PID:     os.Getpid(),
+		Started: d.started,
+		Peers:   len(peers),
+	}, nil
+}
+
+// Client sharing the daemon's transfer list
+func (d *Daemon) newClient() *client.Client {
+	c := d.NewClient()
+	c.Transfers = d.transfers
+	return c
+}
+
+// Push the folder to req's peers with a fresh client
+func (d *Daemon) sync(ctx context.Context, req Request) error {
+	d.pushMu.Lock()
+	defer d.pushMu.Unlock()
+
+	c := d.newClient()
+	c.Peers = req.Peers
+	if req.Parallel > 0 {
+		c.Parallel = req.Parallel
+	}
+	return c.InitSync(ctx, req.Files)
+}
+
+// Wait for the next sync served to a peer
+func (d *Daemon) awaitServed(ctx context.Context) (served, error) {
+	ch := make(chan served, 1)
+	d.waitMu.Lock()
+	d.waiters = append(d.waiters, ch)
+	d.waitMu.Unlock()
+
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-ctx.Done():
+		d.waitMu.Lock()
+		for i, w := range d.waiters {
+			if w == ch {
+				d.waiters = append(d.waiters[:i], d.waiters[i+1:]...)
+				break
+			}
+		}
+		d.waitMu.Unlock()
+		return served{}, ctx.Err()
+	}
+}
+
+// Record a served sync and hand its result to every waiting listen request
+func (d *Daemon) notifyServed(addr string, started time.Time, err error) {
+	d.recordServed(addr, started, err)
+
+	d.waitMu.Lock()
+	waiters := d.waiters
+	d.waiters = nil
+	d.waitMu.Unlock()
+
+	for _, ch := range waiters {
+		ch <- served{addr: addr, err: err}
+	}
+}
@@ -0,0 +1,295 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/client"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Time allowed for HTTP requests to finish once the daemon stops
+const httpShutdownTimeout = 5 * time.Second
+
+// Listen for HTTP API requests on addr
+// Only loopback addresses are allowed, the API is for this machine alone
+func listenHTTP(addr, token string) (net.Listener, error) {
+	if token == "" {
+		return nil, errors.New("HTTP API needs a token")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("HTTP API must listen on a loopback address, not %s", host)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Token stored in path, created with a random value if missing
+func LoadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Static files of the web UI
+//
+//go:embed web
+var webFS embed.FS
+
+// How long the web UI's peer discovery listens for answers
+const discoverWait = 2 * time.Second
+
+// Serve the web UI and HTTP API on lis until ctx is done
+// The UI's files are public, it asks for the token before calling the API
+func (d *Daemon) serveHTTP(ctx context.Context, lis net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", d.handleStatus)
+	mux.HandleFunc("GET /api/peers", d.handlePeers)
+	mux.HandleFunc("POST /api/peers", d.handleRegister)
+	mux.HandleFunc("GET /api/syncs", d.handleSyncs)
+	mux.HandleFunc("POST /api/syncs", func(w http.ResponseWriter, r *http.Request) {
+		d.handleStartSync(ctx, w, r)
+	})
+	mux.HandleFunc("DELETE /api/syncs/{id}", d.handleCancelSync)
+	mux.HandleFunc("GET /api/transfers", d.handleTransfers)
+	mux.HandleFunc("GET /api/history", d.handleHistory)
+	mux.HandleFunc("GET /api/discovered", d.handleDiscovered)
+	mux.HandleFunc("GET /api/approvals", d.handleApprovals)
+	mux.HandleFunc("POST /api/approvals/{id}", d.handleDecide)
+
+	web, _ := fs.Sub(webFS, "web")
+	root := http.NewServeMux()
+	root.Handle("/api/", d.authorize(mux))
+	root.Handle("/", http.FileServerFS(web))
+
+	srv := &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	err := srv.Serve(lis)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "error: HTTP API stopped: %v\n", err)
+	}
+}
+
+// Reject requests without the daemon's bearer token
+func (d *Daemon) authorize(next http.Handler) http.Handler {
+	want := []byte("Bearer " + d.HTTPToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, Response{Error: err.Error()})
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st, err := d.status()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (d *Daemon) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := prot.GetPeers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("unable to get peers: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// Register the peer in the body
+func (d *Daemon) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var peer prot.Peer
+	if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if net.ParseIP(peer.IP) == nil || peer.Port == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid peer %s", peer.Addr()))
+		return
+	}
+	for _, limit := range []string{peer.BwLimitUp, peer.BwLimitDown} {
+		if _, err := prot.ParseSchedule(limit); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := prot.RegisterPeer(peer); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("unable to register peer: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, peer)
+}
+
+func (d *Daemon) handleSyncs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.runningJobs())
+}
+
+// Start a sync with the peers in the body, or every registered peer
+// Runs under the daemon's ctx so it outlives the request
+func (d *Daemon) handleStartSync(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+	}
+	if len(req.Peers) == 0 {
+		peers, err := prot.GetPeers()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("unable to get peers: %w", err))
+			return
+		}
+		req.Peers = peers
+	}
+	if len(req.Peers) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no peers to sync with"))
+		return
+	}
+	for _, p := range req.Peers {
+		if net.ParseIP(p.IP) == nil || p.Port == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid peer %s", p.Addr()))
+			return
+		}
+	}
+	if req.Parallel < 0 || req.Parallel > prot.MaxPendingStreams {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parallel must be between 1 and %d", prot.MaxPendingStreams))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, d.startSync(ctx, req))
+}
+
+func (d *Daemon) handleCancelSync(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid sync id: %w", err))
+		return
+	}
+	if !d.cancelJob(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no running sync %d", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.transfers.List())
+}
+
+// Finished syncs, newest first, at most ?limit= of them
+func (d *Daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", s))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, d.recentJobs(limit))
+}
+
+// Peers answering mDNS discovery
+func (d *Daemon) handleDiscovered(w http.ResponseWriter, r *http.Request) {
+	peers, err := client.DiscoverMDNSPeers(r.Context(), discoverWait)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("unable to discover peers: %w", err))
+		return
+	}
+	if peers == nil {
+		peers = []prot.Peer{}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (d *Daemon) handleApprovals(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.pendingApprovals())
+}
+
+// Accept or reject a pending sync
+// Body {"accept": true}, optionally with "files" to accept only those
+func (d *Daemon) handleDecide(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid approval id: %w", err))
+		return
+	}
+	var body struct {
+		Accept bool     `json:"accept"`
+		Files  []string `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	decision := prot.Decision{Accepted: true, Files: body.Files}
+	if !body.Accept {
+		decision = prot.Decision{Reason: "declined in web UI"}
+	}
+	err = d.decide(id, decision)
+	switch {
+	case errors.Is(err, errNoApproval):
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pending approval %d", id))
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
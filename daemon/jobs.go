@@ -0,0 +1,165 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Finished syncs kept for the history endpoint
+const maxHistory = 100
+
+// Kinds of job
+const (
+	// Sync pushed to peers by this daemon
+	JobPush = "push"
+	// Sync a peer pushed to this daemon
+	JobServe = "serve"
+)
+
+// States of a job
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// One sync run or served by the daemon
+type Job struct {
+	ID       int       `json:"id"`
+	Kind     string    `json:"kind"`
+	Peers    []string  `json:"peers"`
+	Files    []string  `json:"files,omitempty"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"`
+
+	cancel context.CancelFunc
+}
+
+// Register a running push of req
+func (d *Daemon) addJob(req Request, cancel context.CancelFunc) Job {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+	d.nextJob++
+	j := &Job{
+		ID:      d.nextJob,
+		Kind:    JobPush,
+		Files:   req.Files,
+		State:   JobRunning,
+		Started: time.Now(),
+		cancel:  cancel,
+	}
+	for _, p := range req.Peers {
+		j.Peers = append(j.Peers, p.Addr())
+	}
+	d.jobs[j.ID] = j
+	return *j
+}
+
+// Move job id to the history with the outcome err
+func (d *Daemon) finishJob(id int, err error) {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+	j, ok := d.jobs[id]
+	if !ok {
+		return
+	}
+	delete(d.jobs, id)
+	j.cancel()
+	d.recordLocked(*j, err)
+}
+
+// Add a finished job to the history, dropping the oldest when full
+// Caller holds jobsMu
+func (d *Daemon) recordLocked(j Job, err error) {
+	j.Finished = time.Now()
+	j.cancel = nil
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, prot.ErrPeerCanceled):
+		j.State = JobCanceled
+	case err != nil:
+		j.State = JobFailed
+	default:
+		j.State = JobDone
+	}
+	if err != nil {
+		j.Error = err.Error()
+	}
+	d.history = append(d.history, j)
+	if len(d.history) > maxHistory {
+		d.history = d.history[len(d.history)-maxHistory:]
+	}
+}
+
+// Record a sync served to the peer at addr
+func (d *Daemon) recordServed(addr string, started time.Time, err error) {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+	d.nextJob++
+	d.recordLocked(Job{
+		ID:      d.nextJob,
+		Kind:    JobServe,
+		Peers:   []string{addr},
+		Started: started,
+	}, err)
+}
+
+// Push to req's peers, recording the sync as a job
+func (d *Daemon) runSync(ctx context.Context, req Request) error {
+	ctx, cancel := context.WithCancel(ctx)
+	j := d.addJob(req, cancel)
+	err := d.sync(ctx, req)
+	d.finishJob(j.ID, err)
+	return err
+}
+
+// Push to req's peers in the background
+func (d *Daemon) startSync(ctx context.Context, req Request) Job {
+	ctx, cancel := context.WithCancel(ctx)
+	j := d.addJob(req, cancel)
+	go func() {
+		d.finishJob(j.ID, d.sync(ctx, req))
+	}()
+	return j
+}
+
+// Cancel running job id, reporting whether it was found
+func (d *Daemon) cancelJob(id int) bool {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+	j, ok := d.jobs[id]
+	if ok {
+		j.cancel()
+	}
+	return ok
+}
+
+// Running jobs, oldest first
+func (d *Daemon) runningJobs() []Job {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+	list := make([]Job, 0, len(d.jobs))
+	for _, j := range d.jobs {
+		list = append(list, *j)
+	}
+	slices.SortFunc(list, func(a, b Job) int { return a.ID - b.ID })
+	return list
+}
+
+// Up to limit finished jobs, newest first
+func (d *Daemon) recentJobs(limit int) []Job {
+	d.jobsMu.Lock()
+	defer d.jobsMu.Unlock()
+	list := slices.Clone(d.history)
+	slices.Reverse(list)
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Size and modification time of a file, enough to notice edits
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// Stamp every regular file in dir
+func snapshot(dir string) (map[string]fileStamp, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]fileStamp, len(entries))
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed since it was listed
+			continue
+		}
+		files[e.Name()] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	return files, nil
+}
+
+func sameFiles(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, stamp := range a {
+		if other, ok := b[name]; !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// Poll the folder and push to registered peers once changes settle
+// A push waits until the folder looks the same for a whole interval,
+// so files still being written are not sent half done
+func (d *Daemon) watch(ctx context.Context) {
+	last, err := snapshot(d.dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to watch folder: %v\n", err)
+		return
+	}
+
+	ticker := time.NewTicker(d.WatchInterval)
+	defer ticker.Stop()
+	pending := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		files, err := snapshot(d.dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: unable to watch folder: %v\n", err)
+			continue
+		}
+		if !sameFiles(files, last) {
+			last = files
+			pending = true
+			continue
+		}
+		if pending {
+			pending = false
+			d.pushRegistered(ctx, "Folder changed")
+		}
+	}
+}
+
+// Push to registered peers every Interval
+func (d *Daemon) schedule(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.pushRegistered(ctx, "Scheduled sync")
+		}
+	}
+}
+
+// Sync with every registered peer, reporting errors instead of returning them
+func (d *Daemon) pushRegistered(ctx context.Context, reason string) {
+	peers, err := prot.GetPeers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to get peers: %v\n", err)
+		return
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	fmt.Printf("%s, syncing with %d registered peers...\n", reason, len(peers))
+	err = d.runSync(ctx, Request{Peers: peers})
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+}
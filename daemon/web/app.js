@@ -0,0 +1,207 @@
+"use strict";
+
+// How often the page refreshes its view of the daemon
+const refreshMs = 1000;
+
+let token = localStorage.getItem("fsync-token") || "";
+
+async function api(method, path, body) {
+  const res = await fetch(path, {
+    method,
+    headers: {
+      "Authorization": "Bearer " + token,
+      "Content-Type": "application/json",
+    },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (res.status === 401) {
+    signOut();
+    throw new Error("invalid token");
+  }
+  if (res.status === 204) {
+    return null;
+  }
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(data.error || res.statusText);
+  }
+  return data;
+}
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, attrs);
+  node.append(...children);
+  return node;
+}
+
+function formatBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return i === 0 ? n + " B" : n.toFixed(1) + " " + units[i];
+}
+
+function showError(err) {
+  document.getElementById("error").textContent = err ? err.message : "";
+}
+
+function signOut() {
+  token = "";
+  localStorage.removeItem("fsync-token");
+  document.getElementById("app").hidden = true;
+  document.getElementById("login").hidden = false;
+}
+
+// Files unticked in each pending approval, kept across refreshes
+const unpicked = new Map();
+
+function renderApprovals(approvals) {
+  document.getElementById("approvals-section").hidden = approvals.length === 0;
+  for (const id of unpicked.keys()) {
+    if (!approvals.some((a) => a.id === id)) {
+      unpicked.delete(id);
+    }
+  }
+
+  const list = document.getElementById("approvals");
+  list.replaceChildren(...approvals.map((a) => {
+    const conflicts = new Set(a.conflicts || []);
+    const skipped = unpicked.get(a.id) || new Set();
+    unpicked.set(a.id, skipped);
+    const files = el("ul", {}, ...a.files.map((f) => {
+      const label = f.Name + " (" + formatBytes(f.Size) + ")" + (conflicts.has(f.Name) ? " replaces local file" : "");
+      const item = el("li", { className: conflicts.has(f.Name) ? "conflict" : "" });
+      if (a.selectable) {
+        const box = el("input", { type: "checkbox", checked: !skipped.has(f.Name) });
+        box.onchange = () => box.checked ? skipped.delete(f.Name) : skipped.add(f.Name);
+        item.append(el("label", {}, box, " " + label));
+      } else {
+        item.append(label);
+      }
+      return item;
+    }));
+    const decide = (accept) => {
+      const body = { accept };
+      if (accept && skipped.size > 0) {
+        body.files = a.files.map((f) => f.Name).filter((name) => !skipped.has(name));
+      }
+      api("POST", "/api/approvals/" + a.id, body).then(refresh, showError);
+    };
+    return el("div", { className: "approval" },
+      el("p", {}, el("strong", {}, a.peer), " (" + a.addr + ") wants to send " +
+        a.files.length + " files, " + formatBytes(a.total)),
+      files,
+      el("button", { onclick: () => decide(true) }, a.selectable ? "Accept selected" : "Accept"),
+      " ",
+      el("button", { onclick: () => decide(false) }, "Reject"));
+  }));
+}
+
+function renderTransfers(transfers) {
+  document.getElementById("transfers").replaceChildren(...transfers.map((t) => el("tr", {},
+    el("td", {}, t.file),
+    el("td", {}, t.peer),
+    el("td", {}, t.upload ? "sending" : "receiving"),
+    el("td", {}, el("progress", { max: t.total || 1, value: t.total ? t.done : 1 }),
+      formatBytes(t.done) + " of " + formatBytes(t.total)))));
+}
+
+function renderSyncs(running, history) {
+  const row = (j) => el("tr", {},
+    el("td", {}, new Date(j.started).toLocaleString()),
+    el("td", {}, j.kind === "serve" ? "received" : "sent"),
+    el("td", {}, j.peers.join(", ")),
+    el("td", { className: j.state, title: j.error || "" }, j.state),
+    el("td", {}, j.state === "running" && j.kind === "push"
+      ? el("button", { onclick: () => api("DELETE", "/api/syncs/" + j.id).then(refresh, showError) }, "Cancel")
+      : ""));
+  document.getElementById("syncs").replaceChildren(...running.map(row), ...history.map(row));
+}
+
+function renderPeers(peers) {
+  document.getElementById("peers").replaceChildren(...peers.map((p) => el("tr", {},
+    el("td", {}, p.IP + ":" + p.Port),
+    el("td", {}, el("button", { onclick: () => syncWith(p) }, "Sync")))));
+}
+
+function syncWith(peer) {
+  api("POST", "/api/syncs", peer ? { peers: [peer] } : {}).then(refresh, showError);
+}
+
+async function refresh() {
+  if (!token) {
+    return;
+  }
+  try {
+    const [status, approvals, transfers, running, history, peers] = await Promise.all([
+      api("GET", "/api/status"),
+      api("GET", "/api/approvals"),
+      api("GET", "/api/transfers"),
+      api("GET", "/api/syncs"),
+      api("GET", "/api/history?limit=20"),
+      api("GET", "/api/peers"),
+    ]);
+    document.getElementById("folder").textContent = status.dir + " on port " + status.port;
+    renderApprovals(approvals);
+    renderTransfers(transfers);
+    renderSyncs(running, history);
+    renderPeers(peers);
+    document.getElementById("login").hidden = true;
+    document.getElementById("app").hidden = false;
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+document.getElementById("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = document.getElementById("token").value.trim();
+  localStorage.setItem("fsync-token", token);
+  refresh();
+});
+
+document.getElementById("register").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const input = document.getElementById("register-addr");
+  const i = input.value.lastIndexOf(":");
+  if (i < 0) {
+    showError(new Error("expected IP:PORT"));
+    return;
+  }
+  api("POST", "/api/peers", { IP: input.value.slice(0, i), Port: input.value.slice(i + 1) })
+    .then(() => { input.value = ""; refresh(); }, showError);
+});
+
+document.getElementById("sync-all").addEventListener("click", () => syncWith(null));
+
+document.getElementById("discover").addEventListener("click", async () => {
+  const list = document.getElementById("discovered");
+  list.replaceChildren(el("tr", {}, el("td", {}, "Scanning...")));
+  try {
+    const peers = await api("GET", "/api/discovered");
+    list.replaceChildren(...peers.map((p) => el("tr", {},
+      el("td", {}, p.IP + ":" + p.Port),
+      el("td", {},
+        el("button", { onclick: () => syncWith(p) }, "Sync"),
+        " ",
+        el("button", { onclick: () => api("POST", "/api/peers", p).then(refresh, showError) }, "Register")))));
+    if (peers.length === 0) {
+      list.replaceChildren(el("tr", {}, el("td", {}, "No peers found")));
+    }
+  } catch (err) {
+    list.replaceChildren();
+    showError(err);
+  }
+});
+
+if (token) {
+  refresh();
+} else {
+  signOut();
+}
+setInterval(refresh, refreshMs);
@@ -1,11 +1,17 @@
 package directory
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"io"
+	"log/slog"
 	"os"
 	"slices"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/logging"
 )
 
 type DirManager struct {
@@ -52,12 +58,20 @@ func (d DirManager) GetFileNames() ([]string, error) {
 }
 
 // Get file hashes
-func (d DirManager) GetFileHashes(fileNames []string) ([]FileHash, error) {
+func (d DirManager) GetFileHashes(fileNames []string) (hashes []FileHash, err error) {
+	started := time.Now()
+	defer func() {
+		if err != nil {
+			slog.Debug("unable to hash directory", "dir", d.Path, "err", err)
+			return
+		}
+		slog.Debug("hashed directory", "dir", d.Path, "files", len(hashes), "duration", time.Since(started))
+	}()
+
 	if len(fileNames) == 0 {
 		return d.getAllFileHashes()
 	}
 
-	var hashes []FileHash
 	for _, file := range fileNames {
 		entry, err := d.findFileEntry(file)
 		if err != nil {
@@ -100,17 +114,10 @@ func (d DirManager) getAllFileHashes() ([]FileHash, error) {
 
 // Return the SHA256 hash of file
 func (d DirManager) hashFile(entry os.DirEntry) (FileHash, error) {
-	// Open + read file
-	file, err := os.Open(d.Path + "/" + entry.Name())
+	encodedHash, err := HashFile(d.Path + "/" + entry.Name())
 	if err != nil {
 		return FileHash{}, err
 	}
-	fileData := make([]byte, 0)
-	file.Read(fileData)
-
-	// Hash raw file data
-	hash := sha256.Sum256(fileData)
-	encodedHash := hex.EncodeToString(hash[:])
 
 	info, err := entry.Info()
 	if err != nil {
@@ -122,10 +129,28 @@ func (d DirManager) hashFile(entry os.DirEntry) (FileHash, error) {
 		Hash: encodedHash,
 		Size: info.Size(),
 	}
+	slog.Log(context.Background(), logging.LevelTrace, "hashed file", "file", result.Name, "size", result.Size, "hash", result.Hash)
 
 	return result, nil
 }
 
+// Return the hex encoded SHA256 hash of the file at path
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Hash raw file data
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // Find file entry in DirManager path with matching name
 func (d DirManager) findFileEntry(fileName string) (os.DirEntry, error) {
 	if d.Path == "" {
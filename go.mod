@@ -6,12 +6,12 @@ require (
 	github.com/cloudflare/circl v1.6.1
 	github.com/hashicorp/mdns v1.0.6
 	github.com/spf13/cobra v1.9.1
+	github.com/spf13/pflag v1.0.7
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/miekg/dns v1.1.67 // indirect
-	github.com/spf13/pflag v1.0.7 // indirect
 	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/mod v0.26.0 // indirect
 	golang.org/x/net v0.42.0 // indirect
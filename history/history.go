@@ -0,0 +1,196 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of a sync
+const (
+	ResultCompleted = "completed"
+	ResultFailed    = "failed"
+	ResultCanceled  = "canceled"
+	ResultRejected  = "rejected"
+)
+
+// File transferred during a sync
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// One sync session with a peer, written as one line of JSON
+type Entry struct {
+	// When the session started
+	Time time.Time `json:"time"`
+	// Address and hostname of the peer
+	Peer     string `json:"peer"`
+	Hostname string `json:"hostname,omitempty"`
+	// Whether files went to the peer or came from it: send or receive
+	Direction string `json:"direction"`
+	// Files transferred completely, and their total size
+	Files []File `json:"files,omitempty"`
+	Bytes int64  `json:"bytes"`
+	// Seconds taken by the session
+	Duration float64 `json:"duration"`
+	Result   string  `json:"result"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Serializes appends from concurrent sessions
+var appendMu sync.Mutex
+
+// Default history file of the folder at dir
+// Kept outside the folder so peers never sync or overwrite it
+func DefaultPath(dir string) string {
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	sum := sha256.Sum256([]byte(dir))
+	name := filepath.Base(dir) + "-" + hex.EncodeToString(sum[:8]) + ".jsonl"
+	return filepath.Join(state, "fsync", "history", name)
+}
+
+// Append e to the history file at path, creating it when missing
+func Append(path string, e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	appendMu.Lock()
+	defer appendMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("unable to create history directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open history: %w", err)
+	}
+	// One write per entry keeps concurrent writers' lines whole
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write history: %w", err)
+	}
+	return f.Close()
+}
+
+// Read every entry of the history file at path, oldest first
+// A missing file is an empty history
+func Read(path string) ([]Entry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history: %w", err)
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("invalid history entry on line %d: %w", n, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Which entries to show, empty fields match everything
+type Filter struct {
+	// Address, IP or hostname of the peer
+	Peer      string
+	Direction string
+	Result    string
+	// Name or glob pattern of a transferred file
+	File string
+	// Prefix of a transferred file's hash
+	Hash string
+	// Entries from before Since are left out
+	Since time.Time
+}
+
+// Whether e passes every field of f
+func (f Filter) Match(e Entry) bool {
+	if f.Peer != "" && !matchPeer(f.Peer, e) {
+		return false
+	}
+	if f.Direction != "" && e.Direction != f.Direction {
+		return false
+	}
+	if f.Result != "" && e.Result != f.Result {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if f.File != "" || f.Hash != "" {
+		return len(f.Files(e)) > 0
+	}
+	return true
+}
+
+// Files of e matching the file and hash fields of f
+func (f Filter) Files(e Entry) []File {
+	var files []File
+	for _, file := range e.Files {
+		if f.File != "" {
+			if ok, _ := filepath.Match(f.File, file.Name); !ok {
+				continue
+			}
+		}
+		if f.Hash != "" && !strings.HasPrefix(file.Hash, strings.ToLower(f.Hash)) {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// Whether peer names the peer of e by address, IP or hostname
+func matchPeer(peer string, e Entry) bool {
+	if strings.EqualFold(peer, e.Hostname) || peer == e.Peer {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(e.Peer)
+	return err == nil && peer == ip
+}
+
+// Parse the start of a time window: a duration ago, e.g. 72h, a date
+// such as 2006-01-02, or an RFC 3339 time
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration like 72h, a date like 2006-01-02 or an RFC 3339 time", s)
+}
@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+const (
+	// Files up to this size are sent in a batch when the peer supports it
+	BatchFileSize = MaxBodySize
+	// Longest file name accepted in a batch record
+	maxBatchNameSize = 4096
+)
+
+// Small file sent as one record of a batch
+type BatchFile struct {
+	Name string
+	Path string
+}
+
+// Writes a byte stream as full FileData packets
+type packetWriter struct {
+	t   Transport
+	buf []byte
+}
+
+func (w *packetWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), MaxBodySize-len(w.buf))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+		if len(w.buf) == MaxBodySize {
+			if err := w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Send any buffered bytes as a final, possibly short, packet
+func (w *packetWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.t.SendEncryptedPacket(Packet{Body: w.buf, Type: FileData})
+	w.buf = make([]byte, 0, MaxBodySize)
+	return err
+}
+
+// Reads the byte stream carried by FileData packets until the stream ends
+type packetReader struct {
+	t   Transport
+	buf []byte
+}
+
+func (r *packetReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		var pkt Packet
+		err := r.t.ReceiveEncryptedPacket(&pkt)
+		if err != nil {
+			return 0, err
+		}
+		if pkt.Type != FileData {
+			return 0, fmt.Errorf("%w: expected %d, received %d", ErrPacketTypeMismatch, FileData, pkt.Type)
+		}
+		r.buf = pkt.Body
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Send files as records packed into one stream, then close it
+// Stops between records once ctx is done
+func (st *Stream) UploadBatch(ctx context.Context, files []BatchFile) error {
+	var startPkt Packet
+	err := startPkt.SerializeToBody(int64(len(files)), BatchStart)
+	if err != nil {
+		return err
+	}
+	err = st.SendEncryptedPacket(startPkt)
+	if err != nil {
+		return err
+	}
+
+	w := &packetWriter{t: st, buf: make([]byte, 0, MaxBodySize)}
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := st.mux.sock.writeBatchRecord(w, f)
+		if err != nil {
+			return fmt.Errorf("unable to batch %s: %w", f.Name, err)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	return st.Close()
+}
+
+// Write one record: name, size, then the file's bytes
+func (s *SocketHandler) writeBatchRecord(w *packetWriter, f BatchFile) (err error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > BatchFileSize {
+		return fmt.Errorf("%w: %d bytes is too large to batch", ErrInvalidFileSize, info.Size())
+	}
+
+	var header BodyWriter
+	header.String(f.Name)
+	header.Int64(info.Size())
+	_, err = w.Write(header.Bytes())
+	if err != nil {
+		return err
+	}
+
+	report := s.reporter().Start(status.FileTransfer{
+		Peer:   s.peerAddr(),
+		File:   f.Name,
+		Upload: true,
+		Total:  info.Size(),
+	})
+	defer func() { report.Done(err) }()
+	_, err = io.CopyN(w, file, info.Size())
+	return err
+}
+
+// Receive a batch started by UploadBatch
+// resolve validates each record's name and returns where to save it
+// Returns the number of files received
+func (st *Stream) DownloadBatch(ctx context.Context, first Packet, resolve func(name string) (string, error)) (int, error) {
+	var count int64
+	err := first.decodeAs(&count, BatchStart)
+	if err != nil {
+		return 0, err
+	}
+	limits := st.mux.sock.Limits
+	if count < 1 || (limits.MaxFileCount > 0 && count > limits.MaxFileCount) {
+		return 0, fmt.Errorf("%w: batch of %d files", ErrTooManyFiles, count)
+	}
+
+	r := &packetReader{t: st}
+	for i := range count {
+		if err := ctx.Err(); err != nil {
+			return int(i), err
+		}
+		err = st.mux.sock.readBatchRecord(r, resolve)
+		if err != nil {
+			return int(i), err
+		}
+	}
+
+	// Nothing may follow the last record
+	var extra [1]byte
+	if n, err := r.Read(extra[:]); n != 0 || err != io.EOF {
+		return int(count), fmt.Errorf("%w: data after last batch record", ErrMalformed)
+	}
+
+	return int(count), nil
+}
+
+// A partially written file is removed on error
+func (s *SocketHandler) readBatchRecord(r io.Reader, resolve func(string) (string, error)) (err error) {
+	var header [4]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return batchReadError(err)
+	}
+	nameSize := NewBodyReader(header[:]).Uint32()
+	if nameSize == 0 || nameSize > maxBatchNameSize {
+		return fmt.Errorf("%w: batch record name of %d bytes", ErrMalformed, nameSize)
+	}
+
+	rest := make([]byte, nameSize+8)
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return batchReadError(err)
+	}
+	name := string(rest[:nameSize])
+	size := NewBodyReader(rest[nameSize:]).Int64()
+
+	if size < 0 || size > BatchFileSize {
+		return fmt.Errorf("%w: batch record of %d bytes", ErrInvalidFileSize, size)
+	}
+	err = s.reserveSessionBytes(size)
+	if err != nil {
+		return err
+	}
+
+	path, err := resolve(name)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	report := s.reporter().Start(status.FileTransfer{
+		Peer:  s.peerAddr(),
+		File:  name,
+		Total: size,
+	})
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(path)
+		}
+		report.Done(err)
+	}()
+
+	_, err = io.CopyN(file, r, size)
+	if err != nil {
+		return batchReadError(err)
+	}
+	return nil
+}
+
+// A batch that ends mid-record is malformed
+func batchReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: batch ended mid-record", ErrMalformed)
+	}
+	return err
+}
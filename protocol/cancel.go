@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Peer ended the session with a Cancel packet
+var ErrPeerCanceled = errors.New("peer canceled sync")
+
+// Time allowed to deliver a Cancel packet before giving up
+const cancelWriteTimeout = 5 * time.Second
+
+// Lets a context interrupt blocked reads on a socket
+// Shared between copies of a SocketHandler
+type interrupter struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (i *interrupter) get() error {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.err
+}
+
+func (i *interrupter) set(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.err == nil {
+		i.err = err
+	}
+}
+
+// Interrupt reads on the socket once ctx is done
+// Blocked and later reads fail with the context's error
+// Returns a function that stops watching
+func (s *SocketHandler) WatchContext(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		if s.intr == nil || s.Conn == nil {
+			return
+		}
+		s.intr.set(context.Cause(ctx))
+		s.Conn.SetReadDeadline(time.Now())
+	})
+}
+
+// Tell the peer the session is being abandoned and why
+// Safe to call while other goroutines are sending
+func (s *SocketHandler) SendCancel(reason string) error {
+	s.log().Debug("canceling session", "reason", reason)
+	var pkt Packet
+	err := pkt.SerializeToBody(reason, Cancel)
+	if err != nil {
+		return err
+	}
+	return s.sendEncryptedPacket(pkt, cancelWriteTimeout)
+}
+
+// Turn a received Cancel packet into ErrPeerCanceled
+func cancelError(pkt *Packet) error {
+	var reason string
+	if err := pkt.DeserializeBody(&reason); err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerCanceled, err)
+	}
+	return fmt.Errorf("%w: %s", ErrPeerCanceled, reason)
+}
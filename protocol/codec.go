@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Appends primitive values to a message body in wire order
+type BodyWriter struct {
+	buf []byte
+}
+
+func (w *BodyWriter) Bytes() []byte {
+	return w.buf
+}
+
+func (w *BodyWriter) Uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *BodyWriter) Uint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *BodyWriter) Uint64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *BodyWriter) Int64(v int64) {
+	w.Uint64(uint64(v))
+}
+
+func (w *BodyWriter) Bool(v bool) {
+	if v {
+		w.Uint8(1)
+	} else {
+		w.Uint8(0)
+	}
+}
+
+// Write a u32 length followed by raw bytes
+func (w *BodyWriter) Bytes32(v []byte) {
+	w.Uint32(uint32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *BodyWriter) String(v string) {
+	w.Bytes32([]byte(v))
+}
+
+// Reads primitive values from a message body in wire order
+// The first short or invalid read is latched and returned by Err
+type BodyReader struct {
+	buf []byte
+	err error
+}
+
+func NewBodyReader(b []byte) *BodyReader {
+	return &BodyReader{buf: b}
+}
+
+func (r *BodyReader) Err() error {
+	return r.err
+}
+
+// Number of unread bytes
+func (r *BodyReader) Len() int {
+	return len(r.buf)
+}
+
+func (r *BodyReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: "+format, append([]any{ErrMalformed}, args...)...)
+	}
+	r.buf = nil
+}
+
+func (r *BodyReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.fail("need %d bytes, have %d", n, len(r.buf))
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *BodyReader) Uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *BodyReader) Uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *BodyReader) Uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *BodyReader) Int64() int64 {
+	return int64(r.Uint64())
+}
+
+func (r *BodyReader) Bool() bool {
+	switch v := r.Uint8(); v {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		r.fail("invalid bool %d", v)
+		return false
+	}
+}
+
+// Read a u32 length followed by that many bytes
+// Length is checked against the remaining body before allocating
+func (r *BodyReader) Bytes32() []byte {
+	n := r.Uint32()
+	if r.err != nil {
+		return nil
+	}
+	if n > math.MaxInt32 {
+		r.fail("length %d out of range", n)
+		return nil
+	}
+	b := r.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (r *BodyReader) String() string {
+	return string(r.Bytes32())
+}
+
+// Check that the body was consumed exactly
+func (r *BodyReader) Finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(r.buf))
+	}
+	return nil
+}
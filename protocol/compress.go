@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// When to compress packet bodies on a session that negotiated compression
+type CompressionMode int
+
+const (
+	// Compress except for file types that are already compressed
+	CompressAuto CompressionMode = iota
+	// Compress every packet, including already compressed file types
+	CompressAlways
+	// Never compress
+	CompressNever
+)
+
+const (
+	// Set on the wire type of packets whose body is compressed
+	compressedFlag PacketType = 0x80
+	// Bodies smaller than this rarely shrink enough to be worth it
+	minCompressSize = 256
+)
+
+// Extensions of formats that are already compressed
+var compressedExtensions = map[string]bool{
+	".7z": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jpeg": true,
+	".jpg": true, ".m4a": true, ".mkv": true, ".mov": true, ".mp3": true,
+	".mp4": true, ".ogg": true, ".png": true, ".rar": true, ".webm": true,
+	".webp": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// Parse a --compress flag value
+func ParseCompressionMode(s string) (CompressionMode, error) {
+	switch s {
+	case "auto":
+		return CompressAuto, nil
+	case "always":
+		return CompressAlways, nil
+	case "never":
+		return CompressNever, nil
+	}
+	return CompressAuto, fmt.Errorf("invalid compression mode %q, expected auto, always or never", s)
+}
+
+// Report whether the file at path is an already compressed format
+func isCompressedFile(path string) bool {
+	return compressedExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// Compress pkt's body in place when the session allows it and it helps
+func (s *SocketHandler) compressPacket(pkt *Packet) error {
+	if !s.Supports(CapCompression) || s.Compression == CompressNever {
+		return nil
+	}
+	if pkt.Incompressible && s.Compression != CompressAlways {
+		return nil
+	}
+	if len(pkt.Body) < minCompressSize {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(pkt.Body)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	// Fall back to the raw body when compression does not help
+	if buf.Len() < len(pkt.Body) {
+		pkt.Body = buf.Bytes()
+		pkt.Type |= compressedFlag
+	}
+	return nil
+}
+
+// Decompress pkt's body in place if it was sent compressed
+// Output is capped at the largest body a packet may carry
+func (s *SocketHandler) decompressPacket(pkt *Packet) error {
+	if pkt.Type&compressedFlag == 0 {
+		return nil
+	}
+	if !s.Supports(CapCompression) {
+		return fmt.Errorf("%w: compressed packet without negotiated compression", ErrMalformed)
+	}
+
+	const maxBody = streamHeaderSize + MaxBodySize
+	r := flate.NewReader(bytes.NewReader(pkt.Body))
+	defer r.Close()
+	body, err := io.ReadAll(io.LimitReader(r, maxBody+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	if len(body) > maxBody {
+		return fmt.Errorf("%w: compressed body expands past %d bytes", ErrMalformed, maxBody)
+	}
+
+	pkt.Body = body
+	pkt.Type &^= compressedFlag
+	return nil
+}
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Peer declined the offered files
+var ErrRejected = errors.New("peer rejected sync")
+
+// Listener's answer to the files offered by the initiator
+type Decision struct {
+	Accepted bool
+	// Why the files were rejected, empty when accepted
+	Reason string
+	// Names of the accepted files when only some were, nil for all
+	Files []string
+}
+
+// Error reported by the initiator when d rejects the sync
+func (d Decision) Err() error {
+	if d.Accepted {
+		return nil
+	}
+	if d.Reason == "" {
+		return ErrRejected
+	}
+	return fmt.Errorf("%w: %s", ErrRejected, d.Reason)
+}
+
+func (d Decision) MarshalBody(w *BodyWriter) {
+	w.Bool(d.Accepted)
+	w.String(d.Reason)
+}
+
+func (d *Decision) UnmarshalBody(r *BodyReader) {
+	d.Accepted = r.Bool()
+	d.Reason = r.String()
+}
+
+// Decision followed by whether only some files were accepted, and if so
+// their names, for peers supporting selection
+type selectionBody struct {
+	*Decision
+}
+
+// Smallest encoding of a file name: an empty string
+const minFileNameSize = 4
+
+func (b selectionBody) MarshalBody(w *BodyWriter) {
+	b.Decision.MarshalBody(w)
+	w.Bool(b.Files != nil)
+	if b.Files == nil {
+		return
+	}
+	w.Uint32(uint32(len(b.Files)))
+	for _, name := range b.Files {
+		w.String(name)
+	}
+}
+
+func (b selectionBody) UnmarshalBody(r *BodyReader) {
+	b.Decision.UnmarshalBody(r)
+	b.Files = nil
+	if !r.Bool() {
+		return
+	}
+	n := r.Uint32()
+	if r.Err() != nil {
+		return
+	}
+	// Reject counts the remaining body could never hold
+	if uint64(n)*minFileNameSize > uint64(r.Len()) {
+		r.fail("%d file names in %d bytes", n, r.Len())
+		return
+	}
+	b.Files = make([]string, 0, n)
+	for range n {
+		b.Files = append(b.Files, r.String())
+	}
+}
+
+// Send the listener's decision over t
+// Peers without the decision capability only learn whether it was accepted,
+// peers without selection must only be sent all-or-nothing decisions
+func (s *SocketHandler) SendDecision(t Transport, d Decision) error {
+	var pkt Packet
+	var err error
+	switch {
+	case s.Supports(CapSelection):
+		err = pkt.SerializeToBody(selectionBody{&d}, SelectionMsg)
+	case d.Files != nil:
+		return errors.New("peer does not support accepting some of its files")
+	case s.Supports(CapDecision):
+		err = pkt.SerializeToBody(d, DecisionMsg)
+	default:
+		err = pkt.SerializeToBody(d.Accepted, Bool)
+	}
+	if err != nil {
+		return err
+	}
+	return t.SendEncryptedPacket(pkt)
+}
+
+// Wait for the listener's decision over t, allowing for its user to answer
+func (s *SocketHandler) ReceiveDecision(t Transport) (Decision, error) {
+	var d Decision
+	var err error
+	switch {
+	case s.Supports(CapSelection):
+		err = t.ReceivePromptResponse(selectionBody{&d}, SelectionMsg)
+	case s.Supports(CapDecision):
+		err = t.ReceivePromptResponse(&d, DecisionMsg)
+	default:
+		err = t.ReceivePromptResponse(&d.Accepted, Bool)
+	}
+	return d, err
+}
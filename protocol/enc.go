@@ -26,14 +26,13 @@ func (s *SocketHandler) setupServerEncryption() (hpke.Opener, hpke.Sealer, error
 	if err != nil {
 		return nil, nil, err
 	}
-	err = s.Enc.Encode(b)
+	err = s.Enc.WriteFrame(b)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Receive and unmarshal client's public key
-	var publicClientBytes []byte
-	err = s.Dec.Decode(&publicClientBytes)
+	publicClientBytes, err := s.Dec.ReadFrame()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -53,8 +52,7 @@ func (s *SocketHandler) setupServerEncryption() (hpke.Opener, hpke.Sealer, error
 	}
 
 	// Receive client's encapsulated key
-	var clientEnc []byte
-	err = s.Dec.Decode(&clientEnc)
+	clientEnc, err := s.Dec.ReadFrame()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -64,7 +62,7 @@ func (s *SocketHandler) setupServerEncryption() (hpke.Opener, hpke.Sealer, error
 	if err != nil {
 		return nil, nil, err
 	}
-	err = s.Enc.Encode(serverEnc)
+	err = s.Enc.WriteFrame(serverEnc)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -97,8 +95,7 @@ func (s *SocketHandler) setupClientEncryption() (hpke.Opener, hpke.Sealer, error
 	}
 
 	// Receive and unmarshal server's public key
-	var publicServerBytes []byte
-	err = s.Dec.Decode(&publicServerBytes)
+	publicServerBytes, err := s.Dec.ReadFrame()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -112,7 +109,7 @@ func (s *SocketHandler) setupClientEncryption() (hpke.Opener, hpke.Sealer, error
 	if err != nil {
 		return nil, nil, err
 	}
-	err = s.Enc.Encode(pk)
+	err = s.Enc.WriteFrame(pk)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -132,14 +129,13 @@ func (s *SocketHandler) setupClientEncryption() (hpke.Opener, hpke.Sealer, error
 	if err != nil {
 		return nil, nil, err
 	}
-	err = s.Enc.Encode(clientEnc)
+	err = s.Enc.WriteFrame(clientEnc)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Receive server's encapsulated key
-	var serverEnc []byte
-	err = s.Dec.Decode(&serverEnc)
+	serverEnc, err := s.Dec.ReadFrame()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,31 @@
+package protocol
+
+import "errors"
+
+var (
+	// Packet arrived with an order number ahead of the one expected
+	ErrOutOfOrder = errors.New("packet received out of order")
+	// Packet arrived with an order number that was already received
+	ErrReplayedPacket = errors.New("packet replayed")
+	// Packet type differs from the type the receiver expected
+	ErrPacketTypeMismatch = errors.New("packet type mismatch")
+	// Packet body or header failed AEAD authentication
+	ErrPacketAuth = errors.New("packet failed authentication")
+)
+
+var (
+	// Announced file size is negative or over the per-file budget
+	ErrInvalidFileSize = errors.New("invalid file size")
+	// Announced packet count does not match the announced file size
+	ErrPacketCountMismatch = errors.New("packet count does not match file size")
+	// Data packet is not the size its position in the file requires
+	ErrInvalidChunkSize = errors.New("invalid chunk size")
+	// Peer sent more file bytes than the session allows
+	ErrSessionBudgetExceeded = errors.New("session byte budget exceeded")
+	// Peer announced more file hashes than allowed
+	ErrTooManyFiles = errors.New("too many files")
+	// Peer sent nothing before the read deadline
+	ErrReadTimeout = errors.New("read timed out")
+	// Peer accepted nothing before the write deadline
+	ErrWriteTimeout = errors.New("write timed out")
+)
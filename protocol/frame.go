@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Size of the big-endian length prefix on every frame
+	frameHeaderSize = 4
+	// Authentication tag appended to every sealed body by AES-256-GCM
+	aeadOverhead = 16
+	// Largest frame payload: a packet header and a full sealed stream body
+	MaxFrameSize = packetHeaderSize + streamHeaderSize + MaxBodySize + aeadOverhead
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+	ErrMalformed     = errors.New("malformed message")
+)
+
+// Writes length-prefixed frames to an underlying stream
+type FrameWriter struct {
+	w io.Writer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// Write payload as a single frame
+func (fw *FrameWriter) WriteFrame(payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(payload))
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	_, err := fw.w.Write(buf)
+	return err
+}
+
+// Reads length-prefixed frames from an underlying stream
+type FrameReader struct {
+	r       io.Reader
+	maxSize uint32
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r, maxSize: MaxFrameSize}
+}
+
+// Read the next frame payload
+// Frames larger than the reader's maximum are rejected before allocation
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	var header [frameHeaderSize]byte
+	_, err := io.ReadFull(fr.r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > fr.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(fr.r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
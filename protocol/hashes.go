@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"fmt"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+)
+
+// Send file hashes as a count followed by packets of at most MaxBodySize
+func (s *SocketHandler) SendFileHashes(hashes []dir.FileHash) error {
+	return sendFileHashes(s, hashes)
+}
+
+// Receive file hashes sent by SendFileHashes
+func (s *SocketHandler) ReceiveFileHashes() ([]dir.FileHash, error) {
+	return receiveFileHashes(s, s.Limits)
+}
+
+func sendFileHashes(t Transport, hashes []dir.FileHash) error {
+	var countPkt Packet
+	err := countPkt.SerializeToBody(int64(len(hashes)), Int64)
+	if err != nil {
+		return err
+	}
+	err = t.SendEncryptedPacket(countPkt)
+	if err != nil {
+		return err
+	}
+
+	// Fill each packet with as many hashes as fit in the body
+	const listHeaderSize = 4
+	start, size := 0, listHeaderSize
+	for i, h := range hashes {
+		entrySize := minFileHashSize + len(h.Name) + len(h.Hash)
+		if listHeaderSize+entrySize > MaxBodySize {
+			return fmt.Errorf("file hash for %s is too large to send", h.Name)
+		}
+		if size+entrySize > MaxBodySize {
+			err = sendFileHashChunk(t, hashes[start:i])
+			if err != nil {
+				return err
+			}
+			start, size = i, listHeaderSize
+		}
+		size += entrySize
+	}
+	if start < len(hashes) {
+		return sendFileHashChunk(t, hashes[start:])
+	}
+
+	return nil
+}
+
+func sendFileHashChunk(t Transport, hashes []dir.FileHash) error {
+	var pkt Packet
+	err := pkt.SerializeToBody(hashes, FileHashes)
+	if err != nil {
+		return err
+	}
+	return t.SendEncryptedPacket(pkt)
+}
+
+func receiveFileHashes(t Transport, limits Limits) ([]dir.FileHash, error) {
+	var count int64
+	err := t.ReceiveEncryptedData(&count, Int64)
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("%w: negative file count %d", ErrMalformed, count)
+	}
+	if limits.MaxFileCount > 0 && count > limits.MaxFileCount {
+		return nil, fmt.Errorf("%w: %d exceeds limit of %d", ErrTooManyFiles, count, limits.MaxFileCount)
+	}
+
+	hashes := []dir.FileHash{}
+	for int64(len(hashes)) < count {
+		var chunk []dir.FileHash
+		err = t.ReceiveEncryptedData(&chunk, FileHashes)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return nil, fmt.Errorf("%w: empty file hash chunk", ErrMalformed)
+		}
+		if int64(len(hashes)+len(chunk)) > count {
+			return nil, fmt.Errorf("%w: received more than %d file hashes", ErrTooManyFiles, count)
+		}
+		hashes = append(hashes, chunk...)
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// Wire protocol version spoken by this build
+	ProtocolVersion uint32 = 1
+	// Oldest wire protocol version this build can talk to
+	MinProtocolVersion uint32 = 1
+)
+
+// Release version of fsync
+var SoftwareVersion = "0.2.0"
+
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// Optional protocol features a peer can support
+type Capabilities uint32
+
+const (
+	CapCompression Capabilities = 1 << iota
+	CapDelta
+	CapRecursion
+	CapMetadata
+	CapMultiplex
+	CapBatch
+	CapHeartbeat
+	CapDecision
+	CapSelection
+)
+
+// Features implemented by this build, advertised in the hello exchange
+var LocalCapabilities = CapCompression | CapMultiplex | CapBatch | CapHeartbeat | CapDecision | CapSelection
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapCompression, "compression"},
+	{CapDelta, "delta"},
+	{CapRecursion, "recursion"},
+	{CapMetadata, "metadata"},
+	{CapMultiplex, "multiplex"},
+	{CapBatch, "batch"},
+	{CapHeartbeat, "heartbeat"},
+	{CapDecision, "decision"},
+	{CapSelection, "selection"},
+}
+
+// Report whether every capability in o is set
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// First message sent by both peers after the encryption handshake
+type Hello struct {
+	ProtocolVersion uint32
+	SoftwareVersion string
+	Hostname        string
+	Capabilities    Capabilities
+}
+
+// Build the hello message for this host
+func NewHello() Hello {
+	host, _ := os.Hostname()
+	return Hello{
+		ProtocolVersion: ProtocolVersion,
+		SoftwareVersion: SoftwareVersion,
+		Hostname:        host,
+		Capabilities:    LocalCapabilities,
+	}
+}
+
+// Exchange hello messages and negotiate version and capabilities
+// Listener sends first so both sides never block on a send
+func (s *SocketHandler) exchangeHello(listenFlag bool) error {
+	local := NewHello()
+	var peer Hello
+
+	if listenFlag {
+		if err := s.sendHello(local); err != nil {
+			return err
+		}
+		if err := s.ReceiveEncryptedData(&peer, HelloMsg); err != nil {
+			return err
+		}
+	} else {
+		if err := s.ReceiveEncryptedData(&peer, HelloMsg); err != nil {
+			return err
+		}
+		if err := s.sendHello(local); err != nil {
+			return err
+		}
+	}
+
+	if peer.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("%w: peer speaks v%d, need at least v%d", ErrIncompatibleVersion, peer.ProtocolVersion, MinProtocolVersion)
+	}
+
+	s.PeerHello = peer
+	s.Version = min(local.ProtocolVersion, peer.ProtocolVersion)
+	s.Capabilities = local.Capabilities & peer.Capabilities
+
+	return nil
+}
+
+func (s *SocketHandler) sendHello(h Hello) error {
+	var pkt Packet
+	err := pkt.SerializeToBody(h, HelloMsg)
+	if err != nil {
+		return err
+	}
+	return s.SendEncryptedPacket(pkt)
+}
+
+// Report whether both peers negotiated capability c
+func (s *SocketHandler) Supports(c Capabilities) bool {
+	return s.Capabilities.Has(c)
+}
+
+func (h Hello) MarshalBody(w *BodyWriter) {
+	w.Uint32(h.ProtocolVersion)
+	w.String(h.SoftwareVersion)
+	w.String(h.Hostname)
+	w.Uint32(uint32(h.Capabilities))
+}
+
+func (h *Hello) UnmarshalBody(r *BodyReader) {
+	h.ProtocolVersion = r.Uint32()
+	h.SoftwareVersion = r.String()
+	h.Hostname = r.String()
+	h.Capabilities = Capabilities(r.Uint32())
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Bounds on what a peer may send during a session
+// A zero value disables the corresponding check
+type Limits struct {
+	// Largest single file accepted
+	MaxFileSize int64
+	// Total file bytes accepted over the session
+	MaxSessionBytes int64
+	// Largest file hash list accepted
+	MaxFileCount int64
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxFileSize:  1 << 40,
+		MaxFileCount: 1 << 20,
+	}
+}
+
+// Check an announced file size and packet count against the limits
+func (l Limits) checkFileHeader(fileSize int64, totalPackets int64) error {
+	if fileSize < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidFileSize, fileSize)
+	}
+	if l.MaxFileSize > 0 && fileSize > l.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrInvalidFileSize, fileSize, l.MaxFileSize)
+	}
+	if expected := CalculatePktNum(fileSize); totalPackets != expected {
+		return fmt.Errorf("%w: %d packets for %d bytes, expected %d", ErrPacketCountMismatch, totalPackets, fileSize, expected)
+	}
+	return nil
+}
+
+// Reserve size bytes of the session budget for an incoming file
+func (s *SocketHandler) reserveSessionBytes(size int64) error {
+	if s.sessionBytes == nil {
+		s.sessionBytes = new(int64)
+	}
+	total := atomic.AddInt64(s.sessionBytes, size)
+	if max := s.Limits.MaxSessionBytes; max > 0 && total > max {
+		atomic.AddInt64(s.sessionBytes, -size)
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrSessionBudgetExceeded, total, max)
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+)
+
+const (
+	// Stream carrying control traffic, open on both sides from the start
+	ControlStreamID uint32 = 0
+	// Packets a stream may have in flight before the receiver grants more
+	streamWindow = 16
+	// Streams opened by the peer and not yet accepted
+	MaxPendingStreams = 64
+	// Stream id and inner packet type preceding a stream packet's body
+	streamHeaderSize = 5
+)
+
+var (
+	// Peer sent more than its window allows or opened too many streams
+	ErrFlowControl = errors.New("stream flow control violated")
+	// Peer referenced a stream that is not open
+	ErrUnknownStream = errors.New("unknown stream")
+	// Stream was used after it was closed locally
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+// Multiplexes logical streams over one encrypted session
+// Once started, the Mux owns all reads from the socket
+type Mux struct {
+	sock *SocketHandler
+
+	// Parity of the stream ids this side opens, set once
+	parity uint32
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	accept  chan *Stream
+	control *Stream
+
+	done chan struct{}
+	err  error
+}
+
+// Logical, flow-controlled packet channel within a Mux
+// A stream supports one sending and one receiving goroutine at a time
+type Stream struct {
+	ID  uint32
+	mux *Mux
+
+	inbox  chan Packet
+	credit chan struct{}
+	// Packets consumed since the last window update
+	consumed int
+
+	// Guarded by mux.mu
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+// Start multiplexing over an established socket
+// Initiator opens odd stream ids, listener even ones
+func NewMux(s *SocketHandler, initiator bool) *Mux {
+	m := &Mux{
+		sock:    s,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, MaxPendingStreams),
+		done:    make(chan struct{}),
+	}
+	if initiator {
+		m.nextID = 1
+	}
+	m.parity = m.nextID % 2
+	m.control = m.newStream(ControlStreamID)
+
+	go m.readLoop()
+	return m
+}
+
+// Stream for control traffic
+func (m *Mux) Control() *Stream {
+	return m.control
+}
+
+// Open a new stream to the peer
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	id := m.nextID
+	m.nextID += 2
+	m.mu.Unlock()
+
+	st := m.newStream(id)
+	var w BodyWriter
+	w.Uint32(id)
+	err := m.send(Packet{Body: w.Bytes(), Type: StreamOpen})
+	if err != nil {
+		return nil, err
+	}
+
+	m.sock.log().Debug("opened stream", "stream", id)
+	return st, nil
+}
+
+// Wait for the peer to open a stream, giving up once ctx is done
+func (m *Mux) AcceptStream(ctx context.Context) (*Stream, error) {
+	var timer <-chan time.Time
+	if timeout := m.sock.Timeouts.Packet; timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case st := <-m.accept:
+		m.sock.log().Debug("accepted stream", "stream", st.ID)
+		return st, nil
+	case <-m.done:
+		return nil, m.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer:
+		return nil, fmt.Errorf("%w: waiting for stream", ErrReadTimeout)
+	}
+}
+
+// Close the underlying connection and wait for the reader to stop
+func (m *Mux) Close() error {
+	err := m.sock.Conn.Close()
+	<-m.done
+	return err
+}
+
+// Error that ended the session, nil while running
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *Mux) newStream(id uint32) *Stream {
+	st := &Stream{
+		ID:     id,
+		mux:    m,
+		inbox:  make(chan Packet, streamWindow),
+		credit: make(chan struct{}, streamWindow),
+	}
+	for range streamWindow {
+		st.credit <- struct{}{}
+	}
+
+	m.mu.Lock()
+	m.streams[id] = st
+	m.mu.Unlock()
+	return st
+}
+
+func (m *Mux) send(pkt Packet) error {
+	return m.sock.SendEncryptedPacket(pkt)
+}
+
+func (m *Mux) readLoop() {
+	for {
+		var pkt Packet
+		err := m.sock.receiveEncryptedPacket(&pkt, 0)
+		if err == nil {
+			err = m.dispatch(pkt)
+		}
+		if err != nil {
+			m.shutdown(err)
+			return
+		}
+	}
+}
+
+// Route an incoming packet to its stream
+func (m *Mux) dispatch(pkt Packet) error {
+	r := NewBodyReader(pkt.Body)
+	id := r.Uint32()
+
+	switch pkt.Type {
+	case StreamOpen:
+		if err := r.Finish(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		_, exists := m.streams[id]
+		m.mu.Unlock()
+		if exists || id == ControlStreamID || id%2 == m.parity {
+			return fmt.Errorf("%w: peer cannot open stream %d", ErrFlowControl, id)
+		}
+		select {
+		case m.accept <- m.newStream(id):
+		default:
+			return fmt.Errorf("%w: more than %d pending streams", ErrFlowControl, MaxPendingStreams)
+		}
+
+	case StreamData:
+		innerType := r.Uint8()
+		if err := r.Err(); err != nil {
+			return err
+		}
+		st, err := m.lookup(id)
+		if err != nil {
+			return err
+		}
+		// Only this goroutine closes the inbox, so it stays open once checked
+		m.mu.Lock()
+		closed := st.remoteClosed
+		m.mu.Unlock()
+		if closed {
+			return fmt.Errorf("%w: data on stream %d after close", ErrFlowControl, id)
+		}
+		inner := Packet{
+			OrderNum: pkt.OrderNum,
+			Body:     pkt.Body[streamHeaderSize:],
+			Type:     PacketType(innerType),
+		}
+		select {
+		case st.inbox <- inner:
+		default:
+			return fmt.Errorf("%w: stream %d exceeded its window", ErrFlowControl, id)
+		}
+
+	case StreamWindow:
+		n := r.Uint32()
+		if err := r.Finish(); err != nil {
+			return err
+		}
+		// Updates can race a close, so unknown streams are ignored
+		st, err := m.lookup(id)
+		if err != nil {
+			return nil
+		}
+		for range n {
+			select {
+			case st.credit <- struct{}{}:
+			default:
+				return fmt.Errorf("%w: stream %d granted more than its window", ErrFlowControl, id)
+			}
+		}
+
+	case StreamClose:
+		if err := r.Finish(); err != nil {
+			return err
+		}
+		st, err := m.lookup(id)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		if id == ControlStreamID || st.remoteClosed {
+			m.mu.Unlock()
+			return fmt.Errorf("%w: stream %d closed twice", ErrFlowControl, id)
+		}
+		st.remoteClosed = true
+		st.err = io.EOF
+		if st.localClosed {
+			delete(m.streams, id)
+		}
+		m.mu.Unlock()
+		close(st.inbox)
+
+	default:
+		return fmt.Errorf("%w: unexpected packet type %d", ErrPacketTypeMismatch, pkt.Type)
+	}
+
+	return nil
+}
+
+func (m *Mux) lookup(id uint32) (*Stream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.streams[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownStream, id)
+	}
+	return st, nil
+}
+
+// Fail every open stream with err
+func (m *Mux) shutdown(err error) {
+	m.sock.log().Debug("multiplexer stopped", "err", err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.err = err
+	for _, st := range m.streams {
+		if !st.remoteClosed {
+			st.remoteClosed = true
+			st.err = err
+			close(st.inbox)
+		}
+	}
+	close(m.done)
+}
+
+// Send packet on the stream, waiting for window credit
+func (st *Stream) SendEncryptedPacket(pkt Packet) error {
+	if len(pkt.Body) > MaxBodySize {
+		return fmt.Errorf("stream packet of %d bytes exceeds maximum body size", len(pkt.Body))
+	}
+
+	st.mux.mu.Lock()
+	closed := st.localClosed
+	st.mux.mu.Unlock()
+	if closed {
+		return ErrStreamClosed
+	}
+
+	// A peer that stops granting credit is as dead as one that stops sending
+	var timer <-chan time.Time
+	if timeout := st.mux.sock.Timeouts.Packet; timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-st.credit:
+	case <-st.mux.done:
+		return st.mux.err
+	case <-timer:
+		return fmt.Errorf("%w: stream %d has no window", ErrWriteTimeout, st.ID)
+	}
+
+	var w BodyWriter
+	w.Uint32(st.ID)
+	w.Uint8(uint8(pkt.Type))
+	w.buf = append(w.buf, pkt.Body...)
+	return st.mux.send(Packet{Body: w.Bytes(), Type: StreamData, Incompressible: pkt.Incompressible})
+}
+
+// Receive the next packet on the stream
+// Returns io.EOF once the peer has closed the stream
+func (st *Stream) ReceiveEncryptedPacket(pkt *Packet) error {
+	return st.receive(pkt, st.mux.sock.Timeouts.Packet)
+}
+
+func (st *Stream) ReceiveEncryptedData(data any, pktType PacketType) error {
+	var pkt Packet
+	err := st.receive(&pkt, st.mux.sock.Timeouts.Packet)
+	if err != nil {
+		return err
+	}
+	return pkt.decodeAs(data, pktType)
+}
+
+func (st *Stream) ReceivePromptResponse(data any, pktType PacketType) error {
+	var pkt Packet
+	err := st.receive(&pkt, st.mux.sock.Timeouts.Prompt)
+	if err != nil {
+		return err
+	}
+	return pkt.decodeAs(data, pktType)
+}
+
+// Receive the next packet other than a heartbeat
+// Each heartbeat restarts the timeout, as the peer is alive but busy
+func (st *Stream) receive(pkt *Packet, timeout time.Duration) error {
+	for {
+		err := st.next(pkt, timeout)
+		if err != nil || pkt.Type != Heartbeat {
+			return err
+		}
+	}
+}
+
+func (st *Stream) next(pkt *Packet, timeout time.Duration) error {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case p, ok := <-st.inbox:
+		if !ok {
+			return st.err
+		}
+		*pkt = p
+	case <-timer:
+		return fmt.Errorf("%w: stream %d", ErrReadTimeout, st.ID)
+	}
+
+	// Grant the peer more credit once half the window is consumed
+	st.consumed++
+	if st.consumed >= streamWindow/2 {
+		var w BodyWriter
+		w.Uint32(st.ID)
+		w.Uint32(uint32(st.consumed))
+		st.consumed = 0
+		return st.mux.send(Packet{Body: w.Bytes(), Type: StreamWindow})
+	}
+
+	return nil
+}
+
+// Signal the peer that nothing more will be sent on the stream
+func (st *Stream) Close() error {
+	m := st.mux
+	m.mu.Lock()
+	if st.localClosed || st.ID == ControlStreamID {
+		m.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	if st.remoteClosed {
+		delete(m.streams, st.ID)
+	}
+	m.mu.Unlock()
+
+	var w BodyWriter
+	w.Uint32(st.ID)
+	return m.send(Packet{Body: w.Bytes(), Type: StreamClose})
+}
+
+func (st *Stream) SendFileHashes(hashes []dir.FileHash) error {
+	return sendFileHashes(st, hashes)
+}
+
+func (st *Stream) ReceiveFileHashes() ([]dir.FileHash, error) {
+	return receiveFileHashes(st, st.mux.sock.Limits)
+}
+
+func (st *Stream) UploadFile(ctx context.Context, path string) error {
+	return st.mux.sock.uploadFile(ctx, st, path)
+}
+
+func (st *Stream) DownloadFile(ctx context.Context, path string) error {
+	return st.mux.sock.downloadFile(ctx, st, path)
+}
@@ -1,8 +1,11 @@
 package protocol
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
 )
 
 type PacketType int
@@ -13,37 +16,190 @@ const (
 	FileHashes
 	Int64
 	Bool
+	HelloMsg
+	FileName
+	StreamOpen
+	StreamData
+	StreamWindow
+	StreamClose
+	BatchStart
+	Cancel
+	Heartbeat
+	DecisionMsg
+	SelectionMsg
 )
 
+var packetTypeNames = [...]string{
+	EncryptedPacket: "encrypted",
+	FileData:        "file-data",
+	FileHashes:      "file-hashes",
+	Int64:           "int64",
+	Bool:            "bool",
+	HelloMsg:        "hello",
+	FileName:        "file-name",
+	StreamOpen:      "stream-open",
+	StreamData:      "stream-data",
+	StreamWindow:    "stream-window",
+	StreamClose:     "stream-close",
+	BatchStart:      "batch-start",
+	Cancel:          "cancel",
+	Heartbeat:       "heartbeat",
+	DecisionMsg:     "decision",
+	SelectionMsg:    "selection",
+}
+
+// Name of the packet type, marked when the body is compressed
+func (t PacketType) String() string {
+	name := fmt.Sprintf("unknown(%d)", int(t&^compressedFlag))
+	if i := int(t &^ compressedFlag); i >= 0 && i < len(packetTypeNames) {
+		name = packetTypeNames[i]
+	}
+	if t&compressedFlag != 0 {
+		name += "+compressed"
+	}
+	return name
+}
+
+// Size of the type and order number that precede the sealed body
+const packetHeaderSize = 9
+
 type Packet struct {
 	OrderNum int64
 	Body     []byte
 	Type     PacketType
+	// Hint that the body is already compressed, never sent on the wire
+	Incompressible bool
+}
+
+// Message bodies with an explicit wire encoding
+type BodyMarshaler interface {
+	MarshalBody(w *BodyWriter)
+}
+
+type BodyUnmarshaler interface {
+	UnmarshalBody(r *BodyReader)
+}
+
+// Return the packet header in wire order
+// Doubles as AEAD associated data, binding the header to the sealed body
+func (p *Packet) associatedData() []byte {
+	ad := make([]byte, packetHeaderSize)
+	ad[0] = uint8(p.Type)
+	binary.BigEndian.PutUint64(ad[1:], uint64(p.OrderNum))
+	return ad
+}
+
+// Encode packet header and body as a frame payload
+func (p *Packet) MarshalFrame() ([]byte, error) {
+	if p.Type < 0 || p.Type > math.MaxUint8 {
+		return nil, fmt.Errorf("packet type %d out of range", p.Type)
+	}
+	return append(p.associatedData(), p.Body...), nil
+}
+
+// Decode packet header and body from a frame payload
+func (p *Packet) UnmarshalFrame(b []byte) error {
+	if len(b) < packetHeaderSize {
+		return fmt.Errorf("%w: packet of %d bytes", ErrMalformed, len(b))
+	}
+	p.Type = PacketType(b[0])
+	p.OrderNum = int64(binary.BigEndian.Uint64(b[1:packetHeaderSize]))
+	p.Body = b[packetHeaderSize:]
+	return nil
 }
 
 // SerializeToBody data into packet body
 func (p *Packet) SerializeToBody(data any, packetType PacketType) error {
 	p.Type = packetType
 
-	// Gob encode data
-	var dataBuf bytes.Buffer
-	enc := gob.NewEncoder(&dataBuf)
-	err := enc.Encode(data)
-	if err != nil {
-		return err
+	var w BodyWriter
+	switch v := data.(type) {
+	case int64:
+		w.Int64(v)
+	case bool:
+		w.Bool(v)
+	case string:
+		w.String(v)
+	case []byte:
+		w.buf = v
+	case []dir.FileHash:
+		writeFileHashes(&w, v)
+	case BodyMarshaler:
+		v.MarshalBody(&w)
+	default:
+		return fmt.Errorf("cannot serialize %T", data)
 	}
 
-	p.Body = dataBuf.Bytes()
+	p.Body = w.Bytes()
 	return nil
 }
 
 // Deserialize packet body into data
 func (p *Packet) DeserializeBody(data any) error {
-	dec := gob.NewDecoder(bytes.NewReader(p.Body))
-	err := dec.Decode(data)
-	if err != nil {
-		return err
+	r := NewBodyReader(p.Body)
+	switch v := data.(type) {
+	case *int64:
+		*v = r.Int64()
+	case *bool:
+		*v = r.Bool()
+	case *string:
+		*v = r.String()
+	case *[]byte:
+		*v = append([]byte(nil), p.Body...)
+		return nil
+	case *[]dir.FileHash:
+		*v = readFileHashes(r)
+	case BodyUnmarshaler:
+		v.UnmarshalBody(r)
+	default:
+		return fmt.Errorf("cannot deserialize into %T", data)
 	}
 
-	return nil
+	return r.Finish()
+}
+
+// Check the packet type and deserialize the body into data
+func (p *Packet) decodeAs(data any, pktType PacketType) error {
+	if p.Type != pktType {
+		return fmt.Errorf("%w: expected %d, received %d", ErrPacketTypeMismatch, pktType, p.Type)
+	}
+	return p.DeserializeBody(data)
+}
+
+// Smallest encoding of a FileHash: two empty strings and a size
+const minFileHashSize = 4 + 4 + 8
+
+func writeFileHashes(w *BodyWriter, hashes []dir.FileHash) {
+	w.Uint32(uint32(len(hashes)))
+	for _, h := range hashes {
+		w.String(h.Name)
+		w.String(h.Hash)
+		w.Int64(h.Size)
+	}
+}
+
+func readFileHashes(r *BodyReader) []dir.FileHash {
+	n := r.Uint32()
+	if r.Err() != nil {
+		return nil
+	}
+	// Reject counts the remaining body could never hold
+	if uint64(n)*minFileHashSize > uint64(r.Len()) {
+		r.fail("%d file hashes in %d bytes", n, r.Len())
+		return nil
+	}
+
+	hashes := make([]dir.FileHash, 0, n)
+	for range n {
+		h := dir.FileHash{
+			Name: r.String(),
+			Hash: r.String(),
+			Size: r.Int64(),
+		}
+		if r.Err() != nil {
+			return nil
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes
 }
@@ -3,6 +3,8 @@ package protocol
 import (
 	"encoding/json"
 	"os"
+	"slices"
+	"sync"
 )
 
 const peerFile = "peer_data.json"
@@ -10,19 +12,27 @@ const peerFile = "peer_data.json"
 type Peer struct {
 	IP   string
 	Port string
+	// Bandwidth schedules overriding the global limits for this peer
+	BwLimitUp   string `json:",omitempty"`
+	BwLimitDown string `json:",omitempty"`
 }
 
 func (p Peer) Addr() string {
 	return p.IP + ":" + p.Port
 }
 
-// Append peer to peerFile
+// Add peer to peerFile
+// A peer already registered with the same address is replaced, so
+// registering it again updates its bandwidth limits
 func RegisterPeer(p Peer) error {
 	peers, err := GetPeers()
 	if err != nil {
 		return err
 	}
 
+	peers = slices.DeleteFunc(peers, func(existing Peer) bool {
+		return existing.Addr() == p.Addr()
+	})
 	peers = append(peers, p)
 	err = SavePeersToFile(peers)
 	if err != nil {
@@ -71,6 +81,68 @@ func GetPeers() ([]Peer, error) {
 	return peers, nil
 }
 
+// Find a registered peer by IP without creating the peerFile
+func LookupPeer(ip string) (Peer, bool) {
+	if _, err := os.Stat(peerFile); err != nil {
+		return Peer{}, false
+	}
+	peers, err := GetPeers()
+	if err != nil {
+		return Peer{}, false
+	}
+	for _, p := range peers {
+		if p.IP == ip {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Bandwidth schedules for this peer, falling back to up and down
+// Overrides are parsed once per peer, so all of its sessions share them
+func (p Peer) BandwidthLimits(up *Schedule, down *Schedule) (*Schedule, *Schedule, error) {
+	if p.BwLimitUp != "" {
+		s, err := peerSchedule(p.IP+" up", p.BwLimitUp)
+		if err != nil {
+			return nil, nil, err
+		}
+		up = s
+	}
+	if p.BwLimitDown != "" {
+		s, err := peerSchedule(p.IP+" down", p.BwLimitDown)
+		if err != nil {
+			return nil, nil, err
+		}
+		down = s
+	}
+	return up, down, nil
+}
+
+// Parsed peer overrides by peer and direction, replaced when the spec changes
+var (
+	peerSchedulesMu sync.Mutex
+	peerSchedules   = map[string]peerScheduleEntry{}
+)
+
+type peerScheduleEntry struct {
+	spec     string
+	schedule *Schedule
+}
+
+func peerSchedule(key string, spec string) (*Schedule, error) {
+	peerSchedulesMu.Lock()
+	defer peerSchedulesMu.Unlock()
+	if e, ok := peerSchedules[key]; ok && e.spec == spec {
+		return e.schedule, nil
+	}
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	peerSchedules[key] = peerScheduleEntry{spec: spec, schedule: s}
+	return s, nil
+}
+
 func SavePeersToFile(peers []Peer) error {
 	jsonData, err := json.MarshalIndent(peers, "", "")
 	if err != nil {
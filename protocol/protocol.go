@@ -1,14 +1,18 @@
 package protocol
 
 import (
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/circl/hpke"
+	"github.com/sebastian-j-ibanez/fsync/logging"
 	"github.com/sebastian-j-ibanez/fsync/status"
 )
 
@@ -18,14 +22,50 @@ const (
 
 type SocketHandler struct {
 	Conn   net.Conn
-	Enc    *gob.Encoder
-	Dec    *gob.Decoder
+	Enc    *FrameWriter
+	Dec    *FrameReader
 	Opener hpke.Opener
 	Sealer hpke.Sealer
+
+	// Negotiated during the hello exchange
+	PeerHello    Hello
+	Version      uint32
+	Capabilities Capabilities
+
+	// Bounds enforced on everything the peer sends
+	Limits Limits
+	// Deadlines on the connection
+	Timeouts Timeouts
+	// When to compress bodies if both peers support compression
+	Compression CompressionMode
+	// Told about every file sent and received, nil for none
+	Reporter status.Reporter
+
+	// Serializes senders so frames never interleave
+	sendMu *sync.Mutex
+	// Set when a watched context is done
+	intr *interrupter
+	// Hard deadline for every read and write, set during the handshake
+	until time.Time
+	// Records about the session, tagged with the peer's address
+	logger *slog.Logger
+
+	// Order number of the next packet sent and expected
+	sendSeq int64
+	recvSeq int64
+	// File bytes reserved by downloads over the session
+	// Updated atomically as multiplexed streams download concurrently
+	sessionBytes *int64
 }
 
-// Initialize socket handler with connection
+// Initialize socket handler with connection and default timeouts
 func NewSocketHandler(conn net.Conn, listenFlag bool) (SocketHandler, error) {
+	return NewSocketHandlerWithTimeouts(conn, listenFlag, DefaultTimeouts())
+}
+
+// Initialize socket handler with connection
+// The key exchange and hello must finish within the handshake timeout
+func NewSocketHandlerWithTimeouts(conn net.Conn, listenFlag bool, timeouts Timeouts) (SocketHandler, error) {
 	var s SocketHandler
 
 	if conn == nil {
@@ -34,46 +74,105 @@ func NewSocketHandler(conn net.Conn, listenFlag bool) (SocketHandler, error) {
 
 	// Initialize socket connection
 	s.Conn = conn
-	s.Enc = gob.NewEncoder(conn)
-	s.Dec = gob.NewDecoder(conn)
+	s.Enc = NewFrameWriter(conn)
+	s.Dec = NewFrameReader(conn)
+	s.Limits = DefaultLimits()
+	s.Timeouts = timeouts
+	s.sessionBytes = new(int64)
+	s.sendMu = new(sync.Mutex)
+	s.intr = new(interrupter)
+	s.logger = slog.With("peer", conn.RemoteAddr().String())
+
+	if timeouts.Handshake > 0 {
+		s.until = time.Now().Add(timeouts.Handshake)
+		conn.SetDeadline(s.until)
+	}
 
 	if listenFlag {
 		opener, sealer, err := s.setupServerEncryption()
 		if err != nil {
-			return SocketHandler{}, err
+			return SocketHandler{}, During("handshake", err)
 		}
 		s.Opener = opener
 		s.Sealer = sealer
 	} else {
 		opener, sealer, err := s.setupClientEncryption()
 		if err != nil {
-			return SocketHandler{}, err
+			return SocketHandler{}, During("handshake", err)
 		}
 		s.Opener = opener
 		s.Sealer = sealer
 	}
 
+	if err := s.exchangeHello(listenFlag); err != nil {
+		return SocketHandler{}, During("handshake", err)
+	}
+
+	s.until = time.Time{}
+	conn.SetDeadline(time.Time{})
+
+	s.log().Debug("session established",
+		"hostname", s.PeerHello.Hostname,
+		"software", s.PeerHello.SoftwareVersion,
+		"version", s.Version,
+		"capabilities", s.Capabilities.String())
 	return s, nil
 }
 
+// Logger for the session, the default logger when not set up by a constructor
+func (s *SocketHandler) log() *slog.Logger {
+	if s.logger == nil {
+		return slog.Default()
+	}
+	return s.logger
+}
+
+// Log a packet sent or received at trace level
+func (s *SocketHandler) tracePacket(msg string, pkt *Packet, size int) {
+	s.log().LogAttrs(context.Background(), logging.LevelTrace, msg,
+		slog.String("type", pkt.Type.String()),
+		slog.Int("size", size),
+		slog.Int64("order", pkt.OrderNum))
+}
+
 // Open file at path and stream file over socket connection
-func (s SocketHandler) UploadFile(path string) error {
+func (s *SocketHandler) UploadFile(ctx context.Context, path string) error {
+	if s.Enc == nil {
+		return errors.New("socket encoder uninitialized")
+	}
+	return s.uploadFile(ctx, s, path)
+}
+
+// Reporter for the session's files, never nil
+func (s *SocketHandler) reporter() status.Reporter {
+	if s.Reporter == nil {
+		return status.Silent
+	}
+	return s.Reporter
+}
+
+// Address of the peer, empty without a connection
+func (s *SocketHandler) peerAddr() string {
+	if s.Conn == nil {
+		return ""
+	}
+	return s.Conn.RemoteAddr().String()
+}
+
+// Stream file at path over t
+// Stops between packets once ctx is done
+func (s *SocketHandler) uploadFile(ctx context.Context, t Transport, path string) (err error) {
 	// Get file stats
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	fileStat, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Sending \033[1m%s\033[0m\n", file.Name())
-
-	if s.Enc == nil {
-		return errors.New("socket encoder uninitialized")
-	}
-
 	// Calculate and send file size
 	fileSize := fileStat.Size()
 	var fileSizePkt Packet
@@ -82,7 +181,7 @@ func (s SocketHandler) UploadFile(path string) error {
 		return err
 	}
 
-	err = s.SendEncryptedPacket(fileSizePkt)
+	err = t.SendEncryptedPacket(fileSizePkt)
 	if err != nil {
 		return err
 	}
@@ -95,22 +194,28 @@ func (s SocketHandler) UploadFile(path string) error {
 		return err
 	}
 
-	err = s.SendEncryptedPacket(pktNumPkt)
+	err = t.SendEncryptedPacket(pktNumPkt)
 	if err != nil {
 		return err
 	}
 
-	// Write incoming packets to file
-	progress := status.Progress{
-		TimeElapsed:    time.Now().Unix(),
-		Percentage:     0,
-		TotalFileBytes: fileSize,
-		BytesReceived:  0,
-	}
+	s.log().Debug("sending file", "file", filepath.Base(path), "size", fileSize, "packets", pktNum)
+	report := s.reporter().Start(status.FileTransfer{
+		Peer:   s.peerAddr(),
+		File:   filepath.Base(path),
+		Upload: true,
+		Total:  fileSize,
+	})
+	defer func() { report.Done(err) }()
 
 	// Iterate over file, read data, send data in packet
+	incompressible := isCompressedFile(path)
 	offset := int64(0)
-	for i := range pktNum {
+	for range pktNum {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Calculate data size if uneven amount of data left
 		var dataSize int64
 		if (fileSize - offset) < MaxBodySize {
@@ -129,136 +234,245 @@ func (s SocketHandler) UploadFile(path string) error {
 
 		// Create temp packet and send over socket connection
 		tempPkt := Packet{
-			OrderNum: i,
-			Body:     data,
+			Body:           data,
+			Type:           FileData,
+			Incompressible: incompressible,
 		}
-		err = s.SendEncryptedPacket(tempPkt)
+		err = t.SendEncryptedPacket(tempPkt)
 		if err != nil {
 			return err
 		}
 
-		progress.BytesReceived += int64(bytesRead)
-		progress.DisplayProgress()
+		report.Progress(offset)
 	}
 
-	fmt.Print("\n\n")
 	return nil
 }
 
 // Save file at path
-func (s *SocketHandler) DownloadFile(path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-
+// Announced size and packet count are validated before the file is created
+func (s *SocketHandler) DownloadFile(ctx context.Context, path string) error {
 	if s.Dec == nil {
 		return errors.New("socket decoder uninitialized")
 	}
+	stop := s.WatchContext(ctx)
+	defer stop()
+	return s.downloadFile(ctx, s, path)
+}
 
+// Save file received over t at path
+// Limits and session budget are those of the socket carrying t
+// A partially written file is removed on error
+func (s *SocketHandler) downloadFile(ctx context.Context, t Transport, path string) (err error) {
 	// Get file size
 	var fileSize int64
-	err = s.ReceiveEncryptedData(&fileSize, Int64)
+	err = t.ReceiveEncryptedData(&fileSize, Int64)
 	if err != nil {
 		return err
 	}
 
 	// Get number of incoming packets
 	var totalPackets int64
-	err = s.ReceiveEncryptedData(&totalPackets, Int64)
+	err = t.ReceiveEncryptedData(&totalPackets, Int64)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Downloading \033[1m%s\033[0m\n", file.Name())
+	err = s.Limits.checkFileHeader(fileSize, totalPackets)
+	if err != nil {
+		return err
+	}
+	err = s.reserveSessionBytes(fileSize)
+	if err != nil {
+		return err
+	}
 
-	// Write incoming packets to file
-	progress := status.Progress{
-		TimeElapsed:    time.Now().Unix(),
-		Percentage:     0,
-		TotalFileBytes: fileSize,
-		BytesReceived:  0,
+	file, err := os.Create(path)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	s.log().Debug("receiving file", "file", filepath.Base(path), "size", fileSize, "packets", totalPackets)
+	report := s.reporter().Start(status.FileTransfer{
+		Peer:  s.peerAddr(),
+		File:  filepath.Base(path),
+		Total: fileSize,
+	})
+	defer func() { report.Done(err) }()
+
+	// Write incoming packets to file
+	received := int64(0)
 
 	for range totalPackets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		var tempPkt Packet
-		err = s.ReceiveEncryptedPacket(&tempPkt)
+		err = t.ReceiveEncryptedPacket(&tempPkt)
 		if err != nil {
 			return err
 		}
-		bytesWritten, err := file.WriteAt(tempPkt.Body, progress.BytesReceived)
+		if tempPkt.Type != FileData {
+			return fmt.Errorf("%w: expected %d, received %d", ErrPacketTypeMismatch, FileData, tempPkt.Type)
+		}
+
+		// Every packet but the last carries a full body
+		expected := min(fileSize-received, MaxBodySize)
+		if int64(len(tempPkt.Body)) != expected {
+			return fmt.Errorf("%w: expected %d bytes, received %d", ErrInvalidChunkSize, expected, len(tempPkt.Body))
+		}
+
+		bytesWritten, err := file.WriteAt(tempPkt.Body, received)
 		if err != nil {
 			return err
 		}
-		progress.BytesReceived += int64(bytesWritten)
-		progress.DisplayProgress()
+		received += int64(bytesWritten)
+		report.Progress(received)
 	}
 
-	fmt.Print("\n\n")
 	return nil
 }
 
 // Send generic data over socket
+// Packet order number is assigned from the session sequence
 func (s *SocketHandler) SendEncryptedPacket(pkt Packet) error {
+	return s.sendEncryptedPacket(pkt, s.Timeouts.Packet)
+}
+
+// Send pkt, failing if it cannot be written within timeout
+func (s *SocketHandler) sendEncryptedPacket(pkt Packet, timeout time.Duration) error {
 	if s.Enc == nil {
 		return errors.New("socket encoder uninitialized")
 	}
+	if s.sendMu != nil {
+		s.sendMu.Lock()
+		defer s.sendMu.Unlock()
+	}
 
-	ct, err := s.Sealer.Seal(pkt.Body, nil)
+	err := s.compressPacket(&pkt)
+	if err != nil {
+		return err
+	}
+
+	pkt.OrderNum = s.sendSeq
+	ct, err := s.Sealer.Seal(pkt.Body, pkt.associatedData())
 	if err != nil {
 		return err
 	}
 
 	pkt.Body = ct
 
-	err = s.Enc.Encode(pkt)
+	frame, err := pkt.MarshalFrame()
 	if err != nil {
 		return err
 	}
+	err = s.setWriteDeadline(timeout)
+	if err != nil {
+		return err
+	}
+	err = s.Enc.WriteFrame(frame)
+	if err != nil {
+		return wrapWriteError(err)
+	}
+	s.tracePacket("sent packet", &pkt, len(frame))
+	s.sendSeq++
 
 	return nil
 }
 
 // Receive encrypted packet from socket, write to pkt
 func (s *SocketHandler) ReceiveEncryptedPacket(pkt *Packet) error {
+	return s.receiveEncryptedPacket(pkt, s.Timeouts.Packet)
+}
+
+// Receive the next packet other than a heartbeat
+// Each heartbeat restarts the timeout, as the peer is alive but busy
+func (s *SocketHandler) receiveEncryptedPacket(pkt *Packet, timeout time.Duration) error {
+	for {
+		err := s.readPacket(pkt, timeout)
+		if err != nil || pkt.Type != Heartbeat {
+			return err
+		}
+	}
+}
+
+func (s *SocketHandler) readPacket(pkt *Packet, timeout time.Duration) error {
 	if s.Dec == nil {
 		return errors.New("socket decoder uninitialized")
 	}
 
-	err := s.Dec.Decode(pkt)
+	err := s.setReadDeadline(timeout)
 	if err != nil {
 		return err
 	}
-
-	pt, err := s.Opener.Open(pkt.Body, nil)
+	frame, err := s.Dec.ReadFrame()
+	if err != nil {
+		if intrErr := s.intr.get(); intrErr != nil {
+			return intrErr
+		}
+		return wrapReadError(err)
+	}
+	err = pkt.UnmarshalFrame(frame)
 	if err != nil {
 		return err
 	}
+	s.tracePacket("received packet", pkt, len(frame))
+
+	// Reject packets that do not follow the session sequence
+	if pkt.OrderNum < s.recvSeq {
+		return fmt.Errorf("%w: expected %d, received %d", ErrReplayedPacket, s.recvSeq, pkt.OrderNum)
+	}
+	if pkt.OrderNum > s.recvSeq {
+		return fmt.Errorf("%w: expected %d, received %d", ErrOutOfOrder, s.recvSeq, pkt.OrderNum)
+	}
+
+	pt, err := s.Opener.Open(pkt.Body, pkt.associatedData())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPacketAuth, err)
+	}
 
 	pkt.Body = pt
+	s.recvSeq++
+
+	err = s.decompressPacket(pkt)
+	if err != nil {
+		return err
+	}
+	if pkt.Type == Cancel {
+		err := cancelError(pkt)
+		s.log().Debug("peer canceled session", "err", err)
+		return err
+	}
 
 	return nil
 }
 
 // Receive encrypted data and deserialize
 func (s *SocketHandler) ReceiveEncryptedData(data any, pktType PacketType) error {
-	var pkt Packet
-	err := s.ReceiveEncryptedPacket(&pkt)
-	if err != nil {
-		return err
-	}
+	return s.receiveEncryptedData(data, pktType, s.Timeouts.Packet)
+}
 
-	if pkt.Type != pktType {
-		msg := fmt.Sprintf("packet type mismatch: expected %d, received %d", pkt.Type, pktType)
-		return errors.New(msg)
-	}
+// Receive encrypted data that waits on the peer's user
+// Uses the prompt timeout rather than the read timeout
+func (s *SocketHandler) ReceivePromptResponse(data any, pktType PacketType) error {
+	return s.receiveEncryptedData(data, pktType, s.Timeouts.Prompt)
+}
 
-	err = pkt.DeserializeBody(data)
+func (s *SocketHandler) receiveEncryptedData(data any, pktType PacketType, timeout time.Duration) error {
+	var pkt Packet
+	err := s.receiveEncryptedPacket(&pkt, timeout)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return pkt.decodeAs(data, pktType)
 }
 
 // Calculate number of packets based on file size
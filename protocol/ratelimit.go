@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Largest read or write made at once on a rate-limited connection
+const rateChunkSize = 16 << 10
+
+// Bytes-per-second limit that varies by time of day
+// A rate of 0 means unlimited
+// Every connection limited by the same schedule shares its rate
+type Schedule struct {
+	Default int64
+	Windows []RateWindow
+
+	bucket tokenBucket
+}
+
+// Rate applied between two times of day, wrapping past midnight if End < Start
+type RateWindow struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+// Parse a rate such as 512K, 2M or 1G in bytes per second
+// 0, off and unlimited mean no limit
+func ParseRate(input string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(input))
+	switch s {
+	case "", "0", "OFF", "UNLIMITED":
+		return 0, nil
+	}
+
+	n, err := status.ParseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", input)
+	}
+	return n, nil
+}
+
+// Parse a schedule: a default rate optionally followed by windows,
+// e.g. "2M,22:00-07:00=off,12:00-13:00=512K"
+// Returns nil for an empty string
+func ParseSchedule(s string) (*Schedule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, ",")
+	def, err := ParseRate(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	sched := &Schedule{Default: def}
+
+	for _, part := range parts[1:] {
+		span, rate, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule window %q, expected HH:MM-HH:MM=RATE", part)
+		}
+		startStr, endStr, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule window %q, expected HH:MM-HH:MM=RATE", part)
+		}
+
+		var w RateWindow
+		if w.Start, err = parseTimeOfDay(startStr); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseTimeOfDay(endStr); err != nil {
+			return nil, err
+		}
+		if w.Rate, err = ParseRate(rate); err != nil {
+			return nil, err
+		}
+		sched.Windows = append(sched.Windows, w)
+	}
+
+	return sched, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Rate in effect at t, from the first window containing it
+func (s *Schedule) RateAt(t time.Time) int64 {
+	if s == nil {
+		return 0
+	}
+
+	y, m, d := t.Date()
+	sinceMidnight := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	for _, w := range s.Windows {
+		if w.Start <= w.End {
+			if sinceMidnight >= w.Start && sinceMidnight < w.End {
+				return w.Rate
+			}
+		} else if sinceMidnight >= w.Start || sinceMidnight < w.End {
+			return w.Rate
+		}
+	}
+	return s.Default
+}
+
+// Token bucket that paces bytes to a schedule's current rate
+// Tokens may go negative, in which case callers wait off the debt
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Take n bytes from the schedule's bucket
+// Returns how long to wait before using them
+func (s *Schedule) reserve(n int) time.Duration {
+	now := time.Now()
+	rate := s.RateAt(now)
+	if rate <= 0 {
+		return 0
+	}
+	return s.bucket.take(n, now, rate)
+}
+
+func (b *tokenBucket) take(n int, now time.Time, rate int64) time.Duration {
+	// Allow bursts of an eighth of a second, and at least one chunk
+	burst := max(float64(rate)/8, rateChunkSize)
+
+	b.mu.Lock()
+	// Another connection may have taken tokens since now was read
+	if now.Before(b.last) {
+		now = b.last
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.mu.Unlock()
+
+	if debt >= 0 {
+		return 0
+	}
+	return time.Duration(-debt / float64(rate) * float64(time.Second))
+}
+
+// Deadline of one direction of a limited connection, so waiting for the
+// rate limit ends when the read or write would have
+type connDeadline struct {
+	mu sync.Mutex
+	t  time.Time
+	// Closed when t changes
+	changed chan struct{}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+func (d *connDeadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+// Wait for delay, failing as the connection would once the deadline passes
+func (d *connDeadline) wait(delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		t, changed := d.get()
+		var expired <-chan time.Time
+		var deadline *time.Timer
+		if !t.IsZero() {
+			left := time.Until(t)
+			if left <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			deadline = time.NewTimer(left)
+			expired = deadline.C
+		}
+
+		select {
+		case <-timer.C:
+			if deadline != nil {
+				deadline.Stop()
+			}
+			return nil
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		case <-changed:
+			if deadline != nil {
+				deadline.Stop()
+			}
+		}
+	}
+}
+
+// Connection with upload and download rate limits
+type limitedConn struct {
+	net.Conn
+	up   *Schedule
+	down *Schedule
+
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+}
+
+// Wrap conn so writes follow up and reads follow down
+// Connections wrapped with the same schedule share its rate
+// Returns conn unchanged when neither schedule is set
+func NewLimitedConn(conn net.Conn, up *Schedule, down *Schedule) net.Conn {
+	if up == nil && down == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, up: up, down: down}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > rateChunkSize {
+		p = p[:rateChunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	if waitErr := c.readDeadline.wait(c.down.reserve(n)); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), rateChunkSize)]
+		if err := c.writeDeadline.wait(c.up.reserve(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitedConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
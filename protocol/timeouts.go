@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Deadlines applied to a session's connection
+// A zero value disables the corresponding deadline
+type Timeouts struct {
+	// Connecting to a peer
+	Dial time.Duration
+	// Key exchange and hello, from connect to a usable session
+	Handshake time.Duration
+	// Waiting for a peer to connect
+	Idle time.Duration
+	// Between packets read, and for each packet written
+	Packet time.Duration
+	// For the peer's user to answer a prompt
+	Prompt time.Duration
+	// Between heartbeats sent while busy, e.g. hashing
+	// Keep well under the peer's packet timeout
+	Heartbeat time.Duration
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Dial:      10 * time.Second,
+		Handshake: 30 * time.Second,
+		Packet:    2 * time.Minute,
+		Prompt:    30 * time.Minute,
+		Heartbeat: 15 * time.Second,
+	}
+}
+
+// Peer stopped responding during an operation
+type TimeoutError struct {
+	Op  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "peer timed out during " + e.Op
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Attribute a timeout in err to op
+// Other errors, and timeouts already attributed, are returned as is
+func During(op string, err error) error {
+	var te *TimeoutError
+	if err == nil || errors.As(err, &te) {
+		return err
+	}
+	if errors.Is(err, ErrReadTimeout) || errors.Is(err, ErrWriteTimeout) || isNetTimeout(err) {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	return err
+}
+
+func isNetTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Deadline timeout from now, capped by the session's hard deadline
+func (s *SocketHandler) deadline(timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if !s.until.IsZero() && (d.IsZero() || s.until.Before(d)) {
+		d = s.until
+	}
+	return d
+}
+
+// Set the read deadline for the next frame
+func (s *SocketHandler) setReadDeadline(timeout time.Duration) error {
+	if s.Conn == nil {
+		return nil
+	}
+	if err := s.intr.get(); err != nil {
+		return err
+	}
+	err := s.Conn.SetReadDeadline(s.deadline(timeout))
+	if err != nil {
+		return err
+	}
+	// A context done meanwhile may have had its deadline overwritten
+	if err := s.intr.get(); err != nil {
+		s.Conn.SetReadDeadline(time.Now())
+		return err
+	}
+	return nil
+}
+
+// Set the write deadline for the next frame
+func (s *SocketHandler) setWriteDeadline(timeout time.Duration) error {
+	if s.Conn == nil {
+		return nil
+	}
+	return s.Conn.SetWriteDeadline(s.deadline(timeout))
+}
+
+// Translate network timeouts into ErrReadTimeout
+func wrapReadError(err error) error {
+	if isNetTimeout(err) {
+		return fmt.Errorf("%w: %w", ErrReadTimeout, err)
+	}
+	return err
+}
+
+// Translate network timeouts into ErrWriteTimeout
+func wrapWriteError(err error) error {
+	if isNetTimeout(err) {
+		return fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return err
+}
+
+// Send heartbeats on t until the returned function is called
+// Keeps the peer from timing out while this side is busy, e.g. hashing
+// Nothing else may be sent on t until heartbeats stop
+// Does nothing unless both peers support heartbeats
+func (s *SocketHandler) StartHeartbeat(t Transport) func() {
+	interval := s.Timeouts.Heartbeat
+	if interval <= 0 || !s.Supports(CapHeartbeat) {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// A failed send surfaces on the next real packet
+				if err := t.SendEncryptedPacket(Packet{Type: Heartbeat}); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
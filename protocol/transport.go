@@ -0,0 +1,20 @@
+package protocol
+
+import (
+	"context"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+)
+
+// Ordered, encrypted packet channel to a peer
+// Implemented by SocketHandler and by multiplexed Streams
+type Transport interface {
+	SendEncryptedPacket(pkt Packet) error
+	ReceiveEncryptedPacket(pkt *Packet) error
+	ReceiveEncryptedData(data any, pktType PacketType) error
+	ReceivePromptResponse(data any, pktType PacketType) error
+	SendFileHashes(hashes []dir.FileHash) error
+	ReceiveFileHashes() ([]dir.FileHash, error)
+	UploadFile(ctx context.Context, path string) error
+	DownloadFile(ctx context.Context, path string) error
+}
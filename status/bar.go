@@ -0,0 +1,42 @@
+package status
+
+import (
+	"strings"
+	"time"
+)
+
+// Width of the bar in characters
+const barWidth = 20
+
+// Prints a bar for each file, redrawn as the file moves
+// Meant for one transfer at a time, concurrent bars would tear
+type barReporter struct{}
+
+type barReport struct {
+	t       FileTransfer
+	started time.Time
+}
+
+func (barReporter) Start(t FileTransfer) FileReport {
+	verb := "Downloading"
+	if t.Upload {
+		verb = "Sending"
+	}
+	Printf("%s \033[1m%s\033[0m\n", verb, t.File)
+	return &barReport{t: t, started: time.Now()}
+}
+
+func (r *barReport) Progress(done int64) {
+	p := percent(done, r.t.Total)
+	filled := int(p * barWidth / 100)
+	Printf("\r%3d%% \033[32m%s%s\033[0m %s", p,
+		strings.Repeat("━", filled), strings.Repeat(" ", barWidth-filled), formatElapsed(time.Since(r.started)))
+}
+
+func (r *barReport) Done(err error) {
+	// Empty files never report progress, show them complete too
+	if err == nil {
+		r.Progress(r.t.Total)
+	}
+	Printf("\n\n")
+}
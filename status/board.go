@@ -0,0 +1,52 @@
+package status
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Block of status lines redrawn in place, one per concurrent task
+// Nothing else should print while a board is in use
+type Board struct {
+	lines []string
+	drawn int
+}
+
+// Line of a board owned by one task
+type Line struct {
+	board *Board
+	index int
+}
+
+func NewBoard() *Board {
+	return &Board{}
+}
+
+// Add a line to the bottom of the board
+func (b *Board) AddLine(format string, a ...any) *Line {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	b.lines = append(b.lines, fmt.Sprintf(format, a...))
+	b.redraw()
+	return &Line{board: b, index: len(b.lines) - 1}
+}
+
+// Replace the line's text
+func (l *Line) Set(format string, a ...any) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	text := strings.TrimSpace(fmt.Sprintf(format, a...))
+	l.board.lines[l.index] = strings.ReplaceAll(text, "\n", " ")
+	l.board.redraw()
+}
+
+// Caller holds outputMu
+func (b *Board) redraw() {
+	if b.drawn > 0 {
+		fmt.Printf("\033[%dA", b.drawn)
+	}
+	for _, line := range b.lines {
+		fmt.Printf("\r\033[2K%s\n", line)
+	}
+	b.drawn = len(b.lines)
+}
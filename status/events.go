@@ -0,0 +1,140 @@
+package status
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kinds of events
+const (
+	EventSessionStart = "session_start"
+	EventFileStart    = "file_start"
+	EventProgress     = "progress"
+	EventFileDone     = "file_done"
+	EventError        = "error"
+	EventSummary      = "summary"
+)
+
+// Shortest time between two progress events of one file
+const progressEventInterval = 250 * time.Millisecond
+
+// Something that happened during a sync, written as one line of JSON
+// Fields that do not apply to an event, or are zero, are left out
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Address and hostname of the peer
+	Peer     string `json:"peer,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// Whether files go to the peer or come from it: send or receive
+	Direction string `json:"direction,omitempty"`
+	// Peer's software version and the session's features
+	Version  string `json:"version,omitempty"`
+	Features string `json:"features,omitempty"`
+	File     string `json:"file,omitempty"`
+	// Bytes transferred so far, and the size of the file or sync
+	Bytes int64 `json:"bytes,omitzero"`
+	Total int64 `json:"total,omitzero"`
+	// Files transferred, peers synced and peers that failed
+	Files  int `json:"files,omitzero"`
+	Peers  int `json:"peers,omitzero"`
+	Failed int `json:"failed,omitzero"`
+	// Seconds taken by the file or sync
+	Duration float64 `json:"duration,omitzero"`
+	Error    string  `json:"error,omitempty"`
+}
+
+var (
+	eventsMu sync.Mutex
+	events   *json.Encoder
+)
+
+// Write events to w as newline-delimited JSON, or stop when w is nil
+func EmitEvents(w io.Writer) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	events = nil
+	if w != nil {
+		events = json.NewEncoder(w)
+	}
+}
+
+// Whether events are being written
+func EventsEnabled() bool {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	return events != nil
+}
+
+// Write e, timestamped now, if events are being written
+func Emit(e Event) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if events == nil {
+		return
+	}
+	e.Time = time.Now()
+	events.Encode(e)
+}
+
+// Reporter writing the events of every transfer
+// Writes nothing while events are not being written
+type EventReporter struct{}
+
+// Events of one transfer
+type fileEvents struct {
+	start   Event
+	started time.Time
+	last    time.Time
+	done    int64
+}
+
+// Emit the start of transfer t
+func (EventReporter) Start(t FileTransfer) FileReport {
+	direction := "receive"
+	if t.Upload {
+		direction = "send"
+	}
+	f := &fileEvents{
+		start: Event{
+			Type:      EventFileStart,
+			Peer:      t.Peer,
+			Direction: direction,
+			File:      t.File,
+			Total:     t.Total,
+		},
+		started: time.Now(),
+	}
+	Emit(f.start)
+	return f
+}
+
+// Emit the bytes transferred so far, at most every progressEventInterval
+func (f *fileEvents) Progress(done int64) {
+	f.done = done
+	if time.Since(f.last) < progressEventInterval {
+		return
+	}
+	f.last = time.Now()
+	e := f.start
+	e.Type = EventProgress
+	e.Bytes = done
+	Emit(e)
+}
+
+// Emit the end of the transfer, as an error event if err is set
+func (f *fileEvents) Done(err error) {
+	e := f.start
+	e.Type = EventFileDone
+	e.Bytes = f.done
+	e.Duration = time.Since(f.started).Seconds()
+	if err != nil {
+		e.Type = EventError
+		e.Error = err.Error()
+	} else {
+		e.Bytes = f.start.Total
+	}
+	Emit(e)
+}
@@ -0,0 +1,58 @@
+package status
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var outputMu sync.Mutex
+
+// Print a whole line without interleaving with other goroutines
+func Printf(format string, a ...any) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Printf(format, a...)
+}
+
+// Format a byte count with a binary unit, e.g. 1.5 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Parse a size such as 512K, 2M or 1G in bytes
+func ParseSize(input string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(input))
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	// NaN fails every comparison, so check for a valid range
+	if err != nil || !(n >= 0 && n*float64(mult) < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+	return int64(n * float64(mult)), nil
+}
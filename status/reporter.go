@@ -0,0 +1,163 @@
+package status
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// File being sent to or received from a peer
+type FileTransfer struct {
+	Peer   string
+	File   string
+	Upload bool
+	// Size of the file in bytes
+	Total int64
+}
+
+// Follows file transfers, e.g. to show their progress
+// Transfers may run concurrently, each reporting through its own FileReport
+type Reporter interface {
+	// Transfer t started
+	Start(t FileTransfer) FileReport
+}
+
+// Progress of one transfer
+type FileReport interface {
+	// Done bytes have been sent or received so far
+	Progress(done int64)
+	// Transfer ended, and failed if err is set
+	Done(err error)
+}
+
+// How a client shows the progress of its transfers
+type ProgressStyle int
+
+const (
+	// Total view on a terminal, log lines otherwise
+	ProgressAuto ProgressStyle = iota
+	// Bar redrawn for each file
+	ProgressBar
+	// One line for each file once it is done
+	ProgressLog
+	// One line redrawn for every file of a sync, with throughput and ETA
+	ProgressTotal
+	// Nothing
+	ProgressNone
+)
+
+func ParseProgressStyle(s string) (ProgressStyle, error) {
+	switch s {
+	case "auto":
+		return ProgressAuto, nil
+	case "bar":
+		return ProgressBar, nil
+	case "log":
+		return ProgressLog, nil
+	case "total":
+		return ProgressTotal, nil
+	case "none":
+		return ProgressNone, nil
+	}
+	return ProgressAuto, fmt.Errorf("invalid progress style %q, expected auto, bar, log, total or none", s)
+}
+
+// Reporter printing the progress of a sync of files totaling bytes to stdout
+func NewReporter(style ProgressStyle, files int, bytes int64) Reporter {
+	if style == ProgressAuto {
+		style = ProgressLog
+		if stdoutIsTerminal() {
+			style = ProgressTotal
+		}
+	}
+	switch style {
+	case ProgressBar:
+		return barReporter{}
+	case ProgressLog:
+		return logReporter{}
+	case ProgressTotal:
+		return newTotalReporter(files, bytes)
+	}
+	return Silent
+}
+
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Reporter that ignores every transfer
+var Silent Reporter = silentReporter{}
+
+type silentReporter struct{}
+
+func (silentReporter) Start(FileTransfer) FileReport { return silentReporter{} }
+func (silentReporter) Progress(int64)                {}
+func (silentReporter) Done(error)                    {}
+
+// Reporter passing every transfer on to each of reporters
+func Multi(reporters ...Reporter) Reporter {
+	if len(reporters) == 1 {
+		return reporters[0]
+	}
+	return multiReporter(reporters)
+}
+
+type multiReporter []Reporter
+
+type multiReport []FileReport
+
+func (m multiReporter) Start(t FileTransfer) FileReport {
+	reports := make(multiReport, len(m))
+	for i, r := range m {
+		reports[i] = r.Start(t)
+	}
+	return reports
+}
+
+func (m multiReport) Progress(done int64) {
+	for _, r := range m {
+		r.Progress(done)
+	}
+}
+
+func (m multiReport) Done(err error) {
+	for _, r := range m {
+		r.Done(err)
+	}
+}
+
+// Prints one line for each file once it arrived or was sent
+type logReporter struct{}
+
+type logReport struct {
+	t FileTransfer
+}
+
+func (logReporter) Start(t FileTransfer) FileReport { return logReport{t: t} }
+func (logReport) Progress(int64)                    {}
+
+func (r logReport) Done(err error) {
+	if err != nil {
+		return
+	}
+	verb := "Received"
+	if r.t.Upload {
+		verb = "Sent"
+	}
+	Printf("%s \033[1m%s\033[0m (%s)\n", verb, r.t.File, FormatBytes(r.t.Total))
+}
+
+// Percentage of total that done is, a complete 100 for empty files
+func percent(done, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	return done * 100 / total
+}
+
+// Elapsed time as MM:SS
+func formatElapsed(d time.Duration) string {
+	seconds := int64(d.Seconds())
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,99 @@
+package status
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Shortest time between two redraws of the total line
+const totalRedrawInterval = 100 * time.Millisecond
+
+// Prints one line for all the files of a sync, redrawn as they move,
+// with the throughput so far and the time left
+// Safe for concurrent transfers
+type totalReporter struct {
+	mu      sync.Mutex
+	files   int
+	bytes   int64
+	started time.Time
+	drawn   time.Time
+	// Files ended and bytes moved so far
+	doneFiles int
+	doneBytes int64
+	// File most recently started
+	current string
+	// Set once the line has been ended by a newline
+	finished bool
+}
+
+type totalReport struct {
+	r    *totalReporter
+	t    FileTransfer
+	done int64
+}
+
+func newTotalReporter(files int, bytes int64) *totalReporter {
+	return &totalReporter{files: files, bytes: bytes, started: time.Now()}
+}
+
+func (r *totalReporter) Start(t FileTransfer) FileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = t.File
+	r.draw(false)
+	return &totalReport{r: r, t: t}
+}
+
+func (f *totalReport) Progress(done int64) {
+	r := f.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.doneBytes += done - f.done
+	f.done = done
+	r.draw(false)
+}
+
+func (f *totalReport) Done(err error) {
+	r := f.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		// Leave the line as it is for the error that follows
+		r.draw(true)
+		return
+	}
+	r.doneBytes += f.t.Total - f.done
+	f.done = f.t.Total
+	r.doneFiles++
+	r.draw(r.doneFiles == r.files)
+}
+
+// Redraw the line, or end it when final
+// Redraws closer together than totalRedrawInterval are skipped
+// Caller holds r.mu
+func (r *totalReporter) draw(final bool) {
+	if r.finished || (!final && time.Since(r.drawn) < totalRedrawInterval) {
+		return
+	}
+	r.drawn = time.Now()
+
+	elapsed := time.Since(r.started)
+	line := fmt.Sprintf("%d/%d files  %3d%%  %s of %s", r.doneFiles, r.files,
+		percent(r.doneBytes, r.bytes), FormatBytes(r.doneBytes), FormatBytes(r.bytes))
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		rate := float64(r.doneBytes) / seconds
+		line += fmt.Sprintf("  %s/s", FormatBytes(int64(rate)))
+		if !final && rate > 0 && r.bytes > r.doneBytes {
+			left := time.Duration(float64(r.bytes-r.doneBytes) / rate * float64(time.Second))
+			line += "  ETA " + formatElapsed(left)
+		}
+	}
+	if final {
+		line += "  in " + formatElapsed(elapsed) + "\n"
+		r.finished = true
+	} else if r.current != "" {
+		line += "  " + r.current
+	}
+	Printf("\r\033[2K%s", line)
+}
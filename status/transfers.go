@@ -0,0 +1,86 @@
+package status
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// File being sent or received
+type Transfer struct {
+	ID      int       `json:"id"`
+	Peer    string    `json:"peer"`
+	File    string    `json:"file"`
+	Upload  bool      `json:"upload"`
+	Started time.Time `json:"started"`
+	// Bytes moved so far, and the size of the file
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+}
+
+// Reporter listing the transfers in progress, safe for concurrent use
+// A nil *Transfers tracks nothing
+type Transfers struct {
+	mu     sync.Mutex
+	nextID int
+	active map[int]*Transfer
+}
+
+// Entry of a transfer in progress
+type transferReport struct {
+	ts *Transfers
+	id int
+}
+
+func NewTransfers() *Transfers {
+	return &Transfers{active: make(map[int]*Transfer)}
+}
+
+// Record the start of transfer t
+func (ts *Transfers) Start(t FileTransfer) FileReport {
+	if ts == nil {
+		return Silent.Start(t)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.nextID++
+	ts.active[ts.nextID] = &Transfer{
+		ID:      ts.nextID,
+		Peer:    t.Peer,
+		File:    t.File,
+		Upload:  t.Upload,
+		Started: time.Now(),
+		Total:   t.Total,
+	}
+	return transferReport{ts: ts, id: ts.nextID}
+}
+
+func (r transferReport) Progress(done int64) {
+	r.ts.mu.Lock()
+	defer r.ts.mu.Unlock()
+	if t, ok := r.ts.active[r.id]; ok {
+		t.Done = done
+	}
+}
+
+// Forget the transfer once it ended, successfully or not
+func (r transferReport) Done(error) {
+	r.ts.mu.Lock()
+	defer r.ts.mu.Unlock()
+	delete(r.ts.active, r.id)
+}
+
+// Copy of every transfer in progress, oldest first
+func (ts *Transfers) List() []Transfer {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]Transfer, 0, len(ts.active))
+	for _, t := range ts.active {
+		list = append(list, *t)
+	}
+	slices.SortFunc(list, func(a, b Transfer) int { return a.ID - b.ID })
+	return list
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"net"
@@ -49,7 +50,7 @@ func Test2_DownloadFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = s.DownloadFile(destination + "/img-test/3d-geo.jpg")
+	err = s.DownloadFile(context.Background(), destination+"/img-test/3d-geo.jpg")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +81,7 @@ func Test3_InitSync(t *testing.T) {
 
 	// Init sync with peer
 	files := []string{}
-	err = c.InitSync(files)
+	err = c.InitSync(context.Background(), files)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,7 +134,7 @@ func Test6_SendAndReceivePacket(t *testing.T) {
 	c.Peers = append(c.Peers, peer)
 
 	files := []string{}
-	err = c.InitSync(files)
+	err = c.InitSync(context.Background(), files)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,22 +147,22 @@ func RunServer() {
 	}
 
 	files := []string{}
-	err = c.InitSync(files)
+	err = c.InitSync(context.Background(), files)
 	if err != nil {
 		os.Exit(-1)
 	}
 }
 
-func NewClient() (clt.Client, error) {
+func NewClient() (*clt.Client, error) {
 	path, err := os.Getwd()
 	if err != nil {
-		return clt.Client{}, err
+		return nil, err
 	}
 	d, err := dir.NewDirManager(path)
 	if err != nil {
-		return clt.Client{}, err
+		return nil, err
 	}
-	c := clt.Client{
+	c := &clt.Client{
 		DirMan: *d,
 	}
 
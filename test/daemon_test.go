@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	"github.com/sebastian-j-ibanez/fsync/daemon"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+func TestDaemonControlSocket(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, portStr, _ := net.SplitHostPort(lis.Addr().String())
+	lis.Close()
+	port, _ := strconv.Atoi(portStr)
+
+	socket := filepath.Join(t.TempDir(), "fsync.sock")
+	dm := daemon.Daemon{
+		NewClient:  func() *clt.Client { return &clt.Client{DirMan: *d} },
+		Port:       port,
+		SocketPath: socket,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dm.Run(ctx)
+	}()
+
+	var st daemon.Status
+	ok := false
+	for range 50 {
+		if st, ok = daemon.Find(socket, d.Path); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ok {
+		t.Fatal("daemon did not answer status request")
+	}
+	if st.Port != port || st.PID != os.Getpid() {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// Only the folder's own daemon is used
+	if _, ok := daemon.Find(socket, t.TempDir()); ok {
+		t.Fatal("daemon claimed another folder")
+	}
+
+	// A second daemon must not steal the socket
+	second := daemon.Daemon{
+		NewClient:  func() *clt.Client { return &clt.Client{DirMan: *d} },
+		Port:       port + 1,
+		SocketPath: socket,
+	}
+	if err := second.Run(ctx); err == nil {
+		t.Fatal("second daemon started on a busy socket")
+	}
+
+	_, err = daemon.Call(ctx, socket, daemon.Request{Command: "bogus"})
+	if err == nil {
+		t.Fatal("expected unknown command to fail")
+	}
+
+	// Listen requests give up when the caller hangs up
+	callCtx, callCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer callCancel()
+	_, err = daemon.Call(callCtx, socket, daemon.Request{Command: daemon.CommandListen})
+	if err == nil {
+		t.Fatal("expected listen to time out")
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatal("daemon left its socket behind")
+	}
+}
+
+// The control socket lives in a directory private to the user
+func TestDaemonSocketPermissions(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDaemon := func(socket string) daemon.Daemon {
+		port, _ := strconv.Atoi(closedAddr(t).Port)
+		return daemon.Daemon{
+			NewClient:  func() *clt.Client { return &clt.Client{DirMan: *d} },
+			Port:       port,
+			SocketPath: socket,
+		}
+	}
+
+	// Missing directories are created private
+	runDir := filepath.Join(t.TempDir(), "run")
+	socket := filepath.Join(runDir, "fsync.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		dm := newDaemon(socket)
+		errCh <- dm.Run(ctx)
+	}()
+	for range 50 {
+		if _, ok := daemon.Find(socket, d.Path); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	info, err := os.Stat(runDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Fatalf("%s has mode %o, open to other users", runDir, perm)
+	}
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// Directories other users can write to are refused by daemons and clients
+	shared := t.TempDir()
+	os.Chmod(shared, 0777)
+	dm := newDaemon(filepath.Join(shared, "fsync.sock"))
+	if err := dm.Run(context.Background()); err == nil {
+		t.Fatal("daemon listened in a world-writable directory")
+	}
+	if _, err := daemon.Call(context.Background(), filepath.Join(shared, "fsync.sock"), daemon.Request{Command: daemon.CommandStatus}); err == nil {
+		t.Fatal("client used a socket in a world-writable directory")
+	}
+}
+
+// Daemons for different folders get different control sockets
+func TestDefaultSocketPathPerFolder(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	if daemon.DefaultSocketPath(a) == daemon.DefaultSocketPath(b) {
+		t.Fatal("expected each folder to have its own socket")
+	}
+	if daemon.DefaultSocketPath(a) != daemon.DefaultSocketPath(a) {
+		t.Fatal("expected a folder's socket to stay the same")
+	}
+}
+
+func TestDaemonHTTPAPI(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(closedAddr(t).Port)
+	httpAddr := net.JoinHostPort("127.0.0.1", closedAddr(t).Port)
+	dm := daemon.Daemon{
+		NewClient: func() *clt.Client {
+			return &clt.Client{DirMan: *d, Retry: &clt.RetryPolicy{}}
+		},
+		Port:       port,
+		SocketPath: filepath.Join(t.TempDir(), "fsync.sock"),
+		HTTPAddr:   httpAddr,
+		HTTPToken:  "secret",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dm.Run(ctx)
+	}()
+
+	call := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+httpAddr+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		var resp *http.Response
+		for range 50 {
+			resp, err = http.DefaultClient.Do(req)
+			if err == nil {
+				return resp
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	resp := call("GET", "/api/status", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	resp = call("GET", "/api/status", "secret", "")
+	var st daemon.Status
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || st.Dir != d.Path {
+		t.Fatalf("unexpected status %d %+v", resp.StatusCode, st)
+	}
+
+	// A sync with an unreachable peer ends up in the history as failed
+	peer := closedAddr(t)
+	body := fmt.Sprintf(`{"peers":[{"IP":%q,"Port":%q}]}`, peer.IP, peer.Port)
+	resp = call("POST", "/api/syncs", "secret", body)
+	var job daemon.Job
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || job.State != daemon.JobRunning {
+		t.Fatalf("unexpected sync start %d %+v", resp.StatusCode, job)
+	}
+
+	var history []daemon.Job
+	for range 100 {
+		resp = call("GET", "/api/history", "secret", "")
+		json.NewDecoder(resp.Body).Decode(&history)
+		resp.Body.Close()
+		if len(history) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(history) != 1 || history[0].ID != job.ID || history[0].State != daemon.JobFailed {
+		t.Fatalf("unexpected history %+v", history)
+	}
+
+	resp = call("DELETE", "/api/syncs/"+strconv.Itoa(job.ID), "secret", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected finished sync to be gone, got %d", resp.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+}
+
+func TestDaemonWebApproval(t *testing.T) {
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir.Path, "photo.jpg"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(serverDir.Path, "photo.jpg"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir.Path, "notes.txt"), []byte("skip me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := closedAddr(t)
+	port, _ := strconv.Atoi(peer.Port)
+	httpAddr := net.JoinHostPort("127.0.0.1", closedAddr(t).Port)
+	dm := daemon.Daemon{
+		NewClient:  func() *clt.Client { return &clt.Client{DirMan: *serverDir} },
+		Port:       port,
+		SocketPath: filepath.Join(t.TempDir(), "fsync.sock"),
+		HTTPAddr:   httpAddr,
+		HTTPToken:  "secret",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dm.Run(ctx)
+
+	get := func(path string, v any) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://"+httpAddr+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		for range 50 {
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				if v != nil {
+					json.NewDecoder(resp.Body).Decode(v)
+				}
+				return resp.StatusCode
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("daemon HTTP API unreachable")
+		return 0
+	}
+
+	// The UI itself needs no token
+	resp, err := http.Get("http://" + httpAddr + "/")
+	for i := 0; err != nil && i < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+		resp, err = http.Get("http://" + httpAddr + "/")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected UI response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	c := clt.Client{DirMan: *clientDir, Peers: []prot.Peer{peer}, Retry: &clt.RetryPolicy{}}
+	syncErr := make(chan error, 1)
+	go func() {
+		syncErr <- c.InitSync(ctx, nil)
+	}()
+
+	var approvals []daemon.PendingApproval
+	for range 200 {
+		get("/api/approvals", &approvals)
+		if len(approvals) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(approvals) != 1 {
+		t.Fatalf("expected one pending approval, got %+v", approvals)
+	}
+	a := approvals[0]
+	if len(a.Files) != 2 || len(a.Conflicts) != 1 || a.Conflicts[0] != "photo.jpg" || !a.Selectable {
+		t.Fatalf("unexpected approval %+v", a)
+	}
+
+	// Accept only the photo
+	req, _ := http.NewRequest("POST", "http://"+httpAddr+"/api/approvals/"+strconv.Itoa(a.ID), strings.NewReader(`{"accept":true,"files":["photo.jpg"]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected decision response %d", resp.StatusCode)
+	}
+
+	select {
+	case err := <-syncErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("sync did not finish")
+	}
+	data, err := os.ReadFile(filepath.Join(serverDir.Path, "photo.jpg"))
+	if err != nil || string(data) != "new" {
+		t.Fatalf("file not replaced: %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(serverDir.Path, "notes.txt")); !os.IsNotExist(err) {
+		t.Fatal("unselected file was sent")
+	}
+}
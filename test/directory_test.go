@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+)
+
+// Hashes cover the whole contents of each file, so an edit that keeps
+// the size still changes the hash
+func TestFileHashesCoverContents(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := make([]byte, 1<<20)
+	rand.Read(large)
+	contents := map[string][]byte{
+		"empty.txt": {},
+		"notes.txt": []byte("hello"),
+		"large.bin": large,
+	}
+	for name, data := range contents {
+		if err := os.WriteFile(filepath.Join(d.Path, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes, err := d.GetFileHashes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(contents) {
+		t.Fatalf("expected %d hashes, got %d", len(contents), len(hashes))
+	}
+	for _, h := range hashes {
+		sum := sha256.Sum256(contents[h.Name])
+		if h.Hash != hex.EncodeToString(sum[:]) {
+			t.Fatalf("expected the hash of %s to cover its %d bytes, got %s", h.Name, len(contents[h.Name]), h.Hash)
+		}
+	}
+
+	before, err := d.GetFileHashes([]string{"notes.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d.Path, "notes.txt"), []byte("HELLO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after, err := d.GetFileHashes([]string{"notes.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before[0].Hash == after[0].Hash {
+		t.Fatal("expected an edit of the same size to change the hash")
+	}
+}
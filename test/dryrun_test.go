@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Push a new and a changed file, with a dry run on the chosen side
+// Returns the server's notes.txt afterwards and the sync's error
+func syncDryRun(t *testing.T, serverDryRun, clientDryRun bool) (string, error) {
+	t.Helper()
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(serverDir.Path, "notes.txt"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(clientDir.Path, "notes.txt"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(clientDir.Path, "photo.jpg"), []byte("0123456789"), 0644)
+
+	server := clt.Client{DirMan: *serverDir, Policy: &clt.Policy{AcceptAll: true}, DryRun: serverDryRun}
+	peer := startServer(t, &server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := clt.Client{
+		DirMan: *clientDir,
+		Peers:  []prot.Peer{peer},
+		Retry:  &clt.RetryPolicy{},
+		DryRun: clientDryRun,
+	}
+	err = c.InitSync(ctx, nil)
+
+	if _, statErr := os.Stat(filepath.Join(serverDir.Path, "photo.jpg")); statErr == nil && (serverDryRun || clientDryRun) {
+		t.Fatal("dry run created photo.jpg")
+	}
+	notes, _ := os.ReadFile(filepath.Join(serverDir.Path, "notes.txt"))
+	return string(notes), err
+}
+
+func TestDryRunSender(t *testing.T) {
+	notes, err := syncDryRun(t, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes != "old" {
+		t.Fatalf("dry run overwrote notes.txt with %q", notes)
+	}
+}
+
+func TestDryRunListener(t *testing.T) {
+	notes, err := syncDryRun(t, true, false)
+	if !errors.Is(err, prot.ErrPeerCanceled) || !strings.Contains(err.Error(), "dry run") {
+		t.Fatalf("expected the dry run to cancel the sync, got %v", err)
+	}
+	if notes != "old" {
+		t.Fatalf("dry run overwrote notes.txt with %q", notes)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+// Buffer safe to read while events are written
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) events(t *testing.T) []status.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []status.Event
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var e status.Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestSyncEvents(t *testing.T) {
+	var out lockedBuffer
+	status.EmitEvents(&out)
+	defer status.EmitEvents(nil)
+
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(clientDir.Path, "small.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(clientDir.Path, "large.bin"), make([]byte, 3*prot.MaxBodySize), 0644)
+
+	server := clt.Client{DirMan: *serverDir, Policy: &clt.Policy{AcceptAll: true}}
+	peer := startServer(t, &server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := clt.Client{
+		DirMan: *clientDir,
+		Peers:  []prot.Peer{peer},
+		Retry:  &clt.RetryPolicy{},
+	}
+	if err := c.InitSync(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the server's summary too
+	var events []status.Event
+	for range 100 {
+		events = out.events(t)
+		summaries := 0
+		for _, e := range events {
+			if e.Type == status.EventSummary {
+				summaries++
+			}
+		}
+		if summaries == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := map[string]int{}
+	var summaries []status.Event
+	for _, e := range events {
+		switch e.Type {
+		case status.EventFileDone:
+			done[e.Direction+" "+e.File]++
+		case status.EventSummary:
+			summaries = append(summaries, e)
+		case status.EventError:
+			t.Fatalf("unexpected error event %+v", e)
+		}
+	}
+	for _, key := range []string{"send small.txt", "send large.bin", "receive small.txt", "receive large.bin"} {
+		if done[key] != 1 {
+			t.Fatalf("expected one file_done for %s, got events %+v", key, events)
+		}
+	}
+	if events[0].Type != status.EventSessionStart {
+		t.Fatalf("expected session_start first, got %s", events[0].Type)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("expected a summary from each side, got %+v", summaries)
+	}
+	for _, s := range summaries {
+		if s.Files != 2 || s.Bytes != 5+3*prot.MaxBodySize || s.Failed != 0 {
+			t.Fatalf("unexpected summary %+v", s)
+		}
+	}
+}
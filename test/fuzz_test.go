@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Encode a frame payload with its length prefix
+func frameBytes(payload []byte) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func FuzzFrameReader(f *testing.F) {
+	f.Add(frameBytes([]byte("hello")))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fr := prot.NewFrameReader(bytes.NewReader(data))
+		for {
+			frame, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if len(frame) > prot.MaxFrameSize {
+				t.Fatalf("frame of %d bytes exceeds maximum", len(frame))
+			}
+		}
+	})
+}
+
+func FuzzPacketDecode(f *testing.F) {
+	var hashPkt prot.Packet
+	hashPkt.SerializeToBody([]dir.FileHash{{Name: "a", Hash: "b", Size: 1}}, prot.FileHashes)
+	frame, _ := hashPkt.MarshalFrame()
+	f.Add(frame)
+
+	var helloPkt prot.Packet
+	helloPkt.SerializeToBody(prot.NewHello(), prot.HelloMsg)
+	frame, _ = helloPkt.MarshalFrame()
+	f.Add(frame)
+
+	f.Add([]byte{byte(prot.FileHashes), 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{byte(prot.Bool), 0, 0, 0, 0, 0, 0, 0, 0, 2})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pkt prot.Packet
+		if err := pkt.UnmarshalFrame(data); err != nil {
+			return
+		}
+
+		var n int64
+		var b bool
+		var raw []byte
+		var hashes []dir.FileHash
+		var hello prot.Hello
+		pkt.DeserializeBody(&n)
+		pkt.DeserializeBody(&b)
+		pkt.DeserializeBody(&raw)
+		pkt.DeserializeBody(&hello)
+		if err := pkt.DeserializeBody(&hashes); err != nil {
+			return
+		}
+
+		// Anything that decodes must encode back to the same body
+		var again prot.Packet
+		if err := again.SerializeToBody(hashes, prot.FileHashes); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again.Body, pkt.Body) {
+			t.Fatal("file hash list did not round trip")
+		}
+	})
+}
+
+// Run the listener handshake against a peer that sends data as its
+// public key and encapsulated key
+func FuzzServerHandshake(f *testing.F) {
+	f.Add([]byte{}, []byte{})
+	f.Add(make([]byte, 97), make([]byte, 97))
+	f.Add(append([]byte{4}, make([]byte, 96)...), []byte{4})
+
+	f.Fuzz(func(t *testing.T, publicKey []byte, encKey []byte) {
+		serverConn, peerConn := net.Pipe()
+		defer serverConn.Close()
+		defer peerConn.Close()
+		serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		go func() {
+			fr := prot.NewFrameReader(peerConn)
+			fw := prot.NewFrameWriter(peerConn)
+			if _, err := fr.ReadFrame(); err != nil {
+				return
+			}
+			fw.WriteFrame(publicKey)
+			fw.WriteFrame(encKey)
+			peerConn.Close()
+		}()
+
+		prot.NewSocketHandler(serverConn, true)
+	})
+}
+
+// Feed crafted frames to an established session
+func FuzzReceiveEncryptedData(f *testing.F) {
+	f.Add([]byte{byte(prot.Int64), 0, 0, 0, 0, 0, 0, 0, 1}, false)
+	f.Add([]byte{}, true)
+	f.Add(bytes.Repeat([]byte{0xff}, 64), false)
+
+	f.Fuzz(func(t *testing.T, frame []byte, sealed bool) {
+		server, client := newSocketPair(t)
+		server.Timeouts.Packet = time.Second
+
+		go func() {
+			if sealed {
+				// Send a validly sealed packet with a fuzzed body
+				client.SendEncryptedPacket(prot.Packet{Body: frame, Type: prot.FileHashes})
+			} else {
+				client.Enc.WriteFrame(frame)
+			}
+		}()
+
+		var hashes []dir.FileHash
+		server.ReceiveEncryptedData(&hashes, prot.FileHashes)
+	})
+}
+
+// Feed a crafted count and chunk bodies to the hash list exchange
+func FuzzReceiveFileHashes(f *testing.F) {
+	var pkt prot.Packet
+	pkt.SerializeToBody([]dir.FileHash{{Name: "a", Hash: "b", Size: 1}}, prot.FileHashes)
+	f.Add(int64(1), pkt.Body, pkt.Body)
+	f.Add(int64(-1), []byte{}, []byte{})
+	f.Add(int64(1<<62), pkt.Body, []byte{0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, count int64, first []byte, second []byte) {
+		server, client := newSocketPair(t)
+		server.Timeouts.Packet = time.Second
+
+		go func() {
+			var countPkt prot.Packet
+			countPkt.SerializeToBody(count, prot.Int64)
+			client.SendEncryptedPacket(countPkt)
+			client.SendEncryptedPacket(prot.Packet{Body: first, Type: prot.FileHashes})
+			client.SendEncryptedPacket(prot.Packet{Body: second, Type: prot.FileHashes})
+			client.Conn.Close()
+		}()
+
+		hashes, err := server.ReceiveFileHashes()
+		if err == nil && int64(len(hashes)) != count {
+			t.Fatalf("expected %d hashes, received %d", count, len(hashes))
+		}
+	})
+}
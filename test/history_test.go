@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	"github.com/sebastian-j-ibanez/fsync/history"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+func TestSyncHistory(t *testing.T) {
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(clientDir.Path, "notes.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(clientDir.Path, "photo.jpg"), []byte("0123456789"), 0644)
+	hashes, err := clientDir.GetFileHashes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverHistory := filepath.Join(t.TempDir(), "server.jsonl")
+	clientHistory := filepath.Join(t.TempDir(), "client.jsonl")
+	server := clt.Client{DirMan: *serverDir, Policy: &clt.Policy{AcceptAll: true}, History: serverHistory}
+	peer := startServer(t, &server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := clt.Client{
+		DirMan:  *clientDir,
+		Peers:   []prot.Peer{peer},
+		Retry:   &clt.RetryPolicy{},
+		History: clientHistory,
+	}
+	if err := c.InitSync(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	// In sync now, so a second sync transfers nothing and is not recorded
+	if err := c.InitSync(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := history.Read(clientHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server records its side once the session ends
+	var received []history.Entry
+	for range 100 {
+		if received, err = history.Read(serverHistory); err != nil || len(received) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, side := range []struct {
+		entries   []history.Entry
+		direction string
+	}{{sent, "send"}, {received, "receive"}} {
+		if len(side.entries) != 1 {
+			t.Fatalf("expected one %s entry, got %+v", side.direction, side.entries)
+		}
+		e := side.entries[0]
+		if e.Direction != side.direction || e.Result != history.ResultCompleted || e.Bytes != 15 || len(e.Files) != 2 {
+			t.Fatalf("unexpected %s entry %+v", side.direction, e)
+		}
+		for i, file := range e.Files {
+			if file.Name != hashes[i].Name || file.Hash != hashes[i].Hash || file.Size != hashes[i].Size {
+				t.Fatalf("expected %+v, got %+v", hashes[i], file)
+			}
+		}
+	}
+}
+
+// Received files are checked against the hash the sender offered, and a
+// sender's dry run is recorded as canceled by the listener
+func TestHistoryVerifiesReceivedFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		dryRun bool
+		result string
+	}{
+		{"tampered", false, history.ResultFailed},
+		{"dry run", true, history.ResultCanceled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverDir, err := dir.NewDirManager(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientDir, err := dir.NewDirManager(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := filepath.Join(clientDir.Path, "notes.txt")
+			os.WriteFile(src, []byte("hello"), 0644)
+
+			serverHistory := filepath.Join(t.TempDir(), "server.jsonl")
+			server := clt.Client{
+				DirMan:  *serverDir,
+				History: serverHistory,
+				// Change the file after the sender hashed it
+				Approve: func(ctx context.Context, a clt.Approval) (prot.Decision, error) {
+					os.WriteFile(src, []byte("HELLO"), 0644)
+					return prot.Decision{Accepted: true}, nil
+				},
+			}
+			peer := startServer(t, &server)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := clt.Client{
+				DirMan: *clientDir,
+				Peers:  []prot.Peer{peer},
+				Retry:  &clt.RetryPolicy{},
+				DryRun: tc.dryRun,
+			}
+			err = c.InitSync(ctx, nil)
+			if tc.dryRun && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.dryRun && err == nil {
+				t.Fatal("expected a tampered file to fail the sync")
+			}
+
+			var received []history.Entry
+			for range 100 {
+				if received, err = history.Read(serverHistory); err != nil || len(received) > 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(received) != 1 || received[0].Result != tc.result || len(received[0].Files) != 0 {
+				t.Fatalf("expected one %s entry without files, got %+v", tc.result, received)
+			}
+		})
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	entries := []history.Entry{
+		{Time: now.Add(-48 * time.Hour), Peer: "192.168.1.20:8080", Hostname: "laptop", Direction: "send",
+			Files: []history.File{{Name: "notes.txt", Size: 5, Hash: "2cf24dba"}}, Result: history.ResultCompleted},
+		{Time: now.Add(-time.Hour), Peer: "192.168.1.30:53122", Hostname: "desktop", Direction: "receive",
+			Files: []history.File{{Name: "photo.jpg", Size: 10, Hash: "84d89877"}}, Result: history.ResultCompleted},
+		{Time: now, Peer: "192.168.1.30:53200", Hostname: "desktop", Direction: "receive",
+			Result: history.ResultRejected, Error: "declined by user"},
+	}
+	for _, e := range entries {
+		if err := history.Append(path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read, err := history.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("expected %d entries, got %d", len(entries), len(read))
+	}
+
+	tests := []struct {
+		filter history.Filter
+		want   int
+	}{
+		{history.Filter{}, 3},
+		{history.Filter{Peer: "desktop"}, 2},
+		{history.Filter{Peer: "192.168.1.20"}, 1},
+		{history.Filter{Peer: "192.168.1.30:53122"}, 1},
+		{history.Filter{Direction: "receive", Result: history.ResultCompleted}, 1},
+		{history.Filter{File: "*.jpg"}, 1},
+		{history.Filter{Hash: "2CF2"}, 1},
+		{history.Filter{File: "*.txt", Direction: "receive"}, 0},
+		{history.Filter{Since: now.Add(-2 * time.Hour)}, 2},
+	}
+	for _, tt := range tests {
+		n := 0
+		for _, e := range read {
+			if tt.filter.Match(e) {
+				n++
+			}
+		}
+		if n != tt.want {
+			t.Errorf("filter %+v matched %d entries, want %d", tt.filter, n, tt.want)
+		}
+	}
+
+	// A missing history is empty
+	if none, err := history.Read(filepath.Join(t.TempDir(), "missing.jsonl")); err != nil || none != nil {
+		t.Fatalf("expected an empty history, got %v, %v", none, err)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"72h", now.Add(-72 * time.Hour)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-01T08:30:00Z", time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := history.ParseSince(tt.in, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Fatalf("%s: got %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := history.ParseSince("last week", now); err == nil {
+		t.Fatal("expected an invalid time to be rejected")
+	}
+}
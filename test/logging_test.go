@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	"github.com/sebastian-j-ibanez/fsync/logging"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, s := range []string{"trace", "debug", "info", "warn", "error", "DEBUG"} {
+		if _, err := logging.ParseLevel(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	if _, err := logging.ParseLevel("verbose"); err == nil {
+		t.Fatal("expected an invalid level to be rejected")
+	}
+}
+
+// Trace level logs every packet with its type, size and order
+func TestTracePackets(t *testing.T) {
+	var out lockedBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: logging.LevelTrace})))
+
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(clientDir.Path, "small.txt"), []byte("hello"), 0644)
+
+	server := clt.Client{DirMan: *serverDir, Policy: &clt.Policy{AcceptAll: true}}
+	peer := startServer(t, &server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := clt.Client{
+		DirMan: *clientDir,
+		Peers:  []prot.Peer{peer},
+		Retry:  &clt.RetryPolicy{},
+	}
+	if err := c.InitSync(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out.mu.Lock()
+	logs := out.buf.String()
+	out.mu.Unlock()
+	for _, want := range []string{"msg=\"sent packet\"", "msg=\"received packet\"", "order=", "size=", "msg=\"session established\""} {
+		if !strings.Contains(logs, want) {
+			t.Fatalf("expected %s in logs:\n%s", want, logs)
+		}
+	}
+}
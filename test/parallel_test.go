@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Directory holding n files of size random bytes, named a.bin, b.bin, ...
+func parallelDir(t *testing.T, n int, size int) *dir.DirManager {
+	t.Helper()
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := os.WriteFile(filepath.Join(d.Path, fmt.Sprintf("%c.bin", 'a'+i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// Files larger than a stream's window, so an unread stream blocks its sender
+const unreadBlocksSize = 20 * prot.MaxBodySize
+
+// Listener side of a sync, driven step by step by the test
+type fakeListener struct {
+	sock prot.SocketHandler
+	mux  *prot.Mux
+	// Files the initiator offered
+	offered []dir.FileHash
+}
+
+// Listen on a loopback port that is up once this returns, and accept one
+// sync up to the initiator's offer
+func listenForSync(t *testing.T) (prot.Peer, <-chan *fakeListener) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	accepted := make(chan *fakeListener, 1)
+	go func() {
+		// Fails once the test ends and closes lis
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		f := &fakeListener{}
+		if f.sock, err = prot.NewSocketHandler(conn, true); err != nil {
+			t.Error(err)
+			return
+		}
+		f.mux = prot.NewMux(&f.sock, false)
+		if err := f.mux.Control().SendFileHashes(nil); err != nil {
+			t.Error(err)
+			return
+		}
+		if f.offered, err = f.mux.Control().ReceiveFileHashes(); err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- f
+	}()
+
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+	return prot.Peer{IP: host, Port: port}, accepted
+}
+
+// Accept the offered files and return the parallelism the initiator announced
+func (f *fakeListener) accept(t *testing.T) int64 {
+	t.Helper()
+	if err := f.sock.SendDecision(f.mux.Control(), prot.Decision{Accepted: true}); err != nil {
+		t.Fatal(err)
+	}
+	var parallel int64
+	if err := f.mux.Control().ReceiveEncryptedData(&parallel, prot.Int64); err != nil {
+		t.Fatal(err)
+	}
+	return parallel
+}
+
+// Save the file sent on st into path and return its name
+func (f *fakeListener) download(t *testing.T, st *prot.Stream, path string) string {
+	t.Helper()
+	var name string
+	if err := st.ReceiveEncryptedData(&name, prot.FileName); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DownloadFile(context.Background(), filepath.Join(path, name)); err != nil {
+		t.Fatal(err)
+	}
+	var pkt prot.Packet
+	if err := st.ReceiveEncryptedPacket(&pkt); err != io.EOF {
+		t.Fatalf("expected end of stream for %s, received: %v", name, err)
+	}
+	st.Close()
+	return name
+}
+
+// Tell the initiator every file was saved
+func (f *fakeListener) finish(t *testing.T) {
+	t.Helper()
+	var pkt prot.Packet
+	if err := pkt.SerializeToBody(true, prot.Bool); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.mux.Control().SendEncryptedPacket(pkt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Uploads overlap up to the worker count, and every file arrives intact
+func TestParallelUploads(t *testing.T) {
+	clientDir := parallelDir(t, 4, unreadBlocksSize)
+	received := t.TempDir()
+	peer, accepted := listenForSync(t)
+
+	c := clt.Client{DirMan: *clientDir, Peers: []prot.Peer{peer}, Parallel: 2}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.InitSync(context.Background(), nil)
+	}()
+
+	f := <-accepted
+	if n := f.accept(t); n != 2 {
+		t.Fatalf("expected parallelism 2, received %d", n)
+	}
+
+	// Two uploads start at once, and a third waits for one to finish
+	var open []*prot.Stream
+	for range 2 {
+		st, err := f.mux.AcceptStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		open = append(open, st)
+	}
+	next := make(chan *prot.Stream, 2)
+	go func() {
+		for range 2 {
+			st, err := f.mux.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			next <- st
+		}
+	}()
+	select {
+	case <-next:
+		t.Fatal("expected at most 2 uploads at once")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	var names []string
+	for _, st := range open {
+		names = append(names, f.download(t, st, received))
+	}
+	for range 2 {
+		names = append(names, f.download(t, <-next, received))
+	}
+	f.finish(t)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 4 {
+		t.Fatalf("expected 4 files, received %v", names)
+	}
+	for _, name := range names {
+		want, _ := os.ReadFile(filepath.Join(clientDir.Path, name))
+		got, err := os.ReadFile(filepath.Join(received, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("expected %s to arrive intact, received %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// A failed upload ends the sync while the other workers are still sending
+func TestParallelUploadFails(t *testing.T) {
+	clientDir := parallelDir(t, 4, unreadBlocksSize)
+	peer, accepted := listenForSync(t)
+
+	c := clt.Client{DirMan: *clientDir, Peers: []prot.Peer{peer}, Parallel: 4}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.InitSync(context.Background(), nil)
+	}()
+
+	// Remove a file after the initiator hashed it, then leave every
+	// stream unread so the other uploads stay blocked
+	f := <-accepted
+	os.Remove(filepath.Join(clientDir.Path, "a.bin"))
+	f.accept(t)
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sync did not end after an upload failed")
+	}
+	if err == nil || !strings.Contains(err.Error(), "unable to upload a.bin") {
+		t.Fatalf("expected the failed upload in the error, got %v", err)
+	}
+}
+
+// Peers sync at once up to MaxPeers, and each receives every file from a
+// single hash of the directory
+func TestMaxPeersSyncConcurrently(t *testing.T) {
+	var out lockedBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	clientDir := parallelDir(t, 2, 2*prot.MaxBodySize)
+	var peers []prot.Peer
+	var accepted []<-chan *fakeListener
+	for range 2 {
+		peer, ch := listenForSync(t)
+		peers = append(peers, peer)
+		accepted = append(accepted, ch)
+	}
+
+	c := clt.Client{DirMan: *clientDir, Peers: peers, MaxPeers: 2}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.InitSync(context.Background(), nil)
+	}()
+
+	// Neither listener answers until both were offered the files, which
+	// only happens when the peers sync at once
+	var listeners []*fakeListener
+	for _, ch := range accepted {
+		select {
+		case f := <-ch:
+			listeners = append(listeners, f)
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected both peers to sync at once")
+		}
+	}
+
+	var received []string
+	for _, f := range listeners {
+		path := t.TempDir()
+		received = append(received, path)
+		f.accept(t)
+		for range len(f.offered) {
+			st, err := f.mux.AcceptStream(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.download(t, st, path)
+		}
+		f.finish(t)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	out.mu.Lock()
+	logs := out.buf.String()
+	out.mu.Unlock()
+	if n := strings.Count(logs, "msg=\"hashed directory\" dir="+clientDir.Path+" "); n != 1 {
+		t.Fatalf("expected the directory to be hashed once, hashed %d times", n)
+	}
+
+	for _, path := range received {
+		for _, name := range []string{"a.bin", "b.bin"} {
+			want, _ := os.ReadFile(filepath.Join(clientDir.Path, name))
+			got, err := os.ReadFile(filepath.Join(path, name))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("expected %s to arrive intact in %s, received %d bytes, %v", name, path, len(got), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Push a file named name to a server deciding with policy
+func syncWithPolicy(t *testing.T, policy *clt.Policy, name string) (string, error) {
+	t.Helper()
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir.Path, name), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := clt.Client{DirMan: *serverDir, Policy: policy}
+	peer := startServer(t, &server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := clt.Client{
+		DirMan: *clientDir,
+		Peers:  []prot.Peer{peer},
+		Retry:  &clt.RetryPolicy{},
+	}
+	err = c.InitSync(ctx, nil)
+	return serverDir.Path, err
+}
+
+func TestPolicyRejectsWithReason(t *testing.T) {
+	_, err := syncWithPolicy(t, &clt.Policy{MaxTotalSize: "5"}, "big.bin")
+	if !errors.Is(err, prot.ErrRejected) {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("rejection does not carry the reason: %v", err)
+	}
+
+	_, err = syncWithPolicy(t, &clt.Policy{AllowedExtensions: []string{".jpg"}}, "notes.txt")
+	if !errors.Is(err, prot.ErrRejected) || !strings.Contains(err.Error(), "notes.txt") {
+		t.Fatalf("expected rejection of notes.txt, got %v", err)
+	}
+
+	// The hostname a peer claims in its hello does not get it past the allow-list
+	host, _ := os.Hostname()
+	_, err = syncWithPolicy(t, &clt.Policy{AllowedPeers: []string{host}}, "notes.txt")
+	if !errors.Is(err, prot.ErrRejected) || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected rejection of peer claiming %s, got %v", host, err)
+	}
+}
+
+func TestPolicyAccepts(t *testing.T) {
+	path, err := syncWithPolicy(t, &clt.Policy{AllowedExtensions: []string{".JPG"}, AllowedPeers: []string{"127.0.0.1"}}, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "photo.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = syncWithPolicy(t, &clt.Policy{AutoAcceptFrom: []string{"127.0.0.1"}, AllowedPeers: []string{"10.0.0.1", "127.0.0.1"}}, "any.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`{"max_total_size": "1G", "allowed_extensions": [".jpg"]}`), 0644)
+	p, err := clt.LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxTotalSize != "1G" || len(p.AllowedExtensions) != 1 {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+
+	// Sizes are not rates, so the error names a size
+	os.WriteFile(path, []byte(`{"max_total_size": "off"}`), 0644)
+	if _, err := clt.LoadPolicy(path); err == nil || !strings.Contains(err.Error(), `max_total_size: invalid size "off"`) {
+		t.Fatalf("expected an invalid size error, got %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"max_size": "1G"}`,
+		`{"max_total_size": "lots"}`,
+		`{"max_total_size": "unlimited"}`,
+		`{"allowed_extensions": ["jpg"]}`,
+		`{"allowed_peers": ["laptop"]}`,
+		`{"auto_accept_from": ["laptop:8080"]}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0644)
+		if _, err := clt.LoadPolicy(path); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
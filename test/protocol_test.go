@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Create a connected pair of socket handlers over an in-memory pipe
+func newSocketPair(t *testing.T) (*prot.SocketHandler, *prot.SocketHandler) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	return newSocketPairOver(t, serverConn, clientConn)
+}
+
+// Create a connected pair of socket handlers over the given connections
+func newSocketPairOver(t *testing.T, serverConn net.Conn, clientConn net.Conn) (*prot.SocketHandler, *prot.SocketHandler) {
+	t.Helper()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	type result struct {
+		s   prot.SocketHandler
+		err error
+	}
+	serverCh := make(chan result, 1)
+	go func() {
+		s, err := prot.NewSocketHandler(serverConn, true)
+		serverCh <- result{s, err}
+	}()
+
+	client, err := prot.NewSocketHandler(clientConn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-serverCh
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	return &res.s, &client
+}
+
+func TestEncryptedPacketSequence(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	go func() {
+		for i := range int64(3) {
+			var pkt prot.Packet
+			pkt.SerializeToBody(i, prot.Int64)
+			client.SendEncryptedPacket(pkt)
+		}
+	}()
+
+	for i := range int64(3) {
+		var n int64
+		if err := server.ReceiveEncryptedData(&n, prot.Int64); err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Fatalf("expected: %d\treceived: %d", i, n)
+		}
+	}
+}
+
+func TestEncryptedPacketTypeMismatch(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	go func() {
+		var pkt prot.Packet
+		pkt.SerializeToBody(true, prot.Bool)
+		client.SendEncryptedPacket(pkt)
+	}()
+
+	var n int64
+	err := server.ReceiveEncryptedData(&n, prot.Int64)
+	if !errors.Is(err, prot.ErrPacketTypeMismatch) {
+		t.Fatalf("expected type mismatch, received: %v", err)
+	}
+}
+
+func TestEncryptedPacketReplay(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	go func() {
+		var pkt prot.Packet
+		pkt.SerializeToBody(true, prot.Bool)
+		client.SendEncryptedPacket(pkt)
+
+		// Resend a packet claiming the first order number
+		replay := prot.Packet{OrderNum: 0, Type: prot.Bool}
+		frame, _ := replay.MarshalFrame()
+		client.Enc.WriteFrame(frame)
+	}()
+
+	var ok bool
+	if err := server.ReceiveEncryptedData(&ok, prot.Bool); err != nil {
+		t.Fatal(err)
+	}
+	err := server.ReceiveEncryptedData(&ok, prot.Bool)
+	if !errors.Is(err, prot.ErrReplayedPacket) {
+		t.Fatalf("expected replay, received: %v", err)
+	}
+}
+
+func TestEncryptedPacketUnboundHeader(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	go func() {
+		// Seal without binding the header, as a forged packet would
+		var pkt prot.Packet
+		pkt.SerializeToBody(int64(1), prot.Int64)
+		// Order number 1 follows the hello packet
+		ct, _ := client.Sealer.Seal(pkt.Body, nil)
+		forged := prot.Packet{OrderNum: 1, Body: ct, Type: prot.Int64}
+		frame, _ := forged.MarshalFrame()
+		client.Enc.WriteFrame(frame)
+	}()
+
+	var n int64
+	err := server.ReceiveEncryptedData(&n, prot.Int64)
+	if !errors.Is(err, prot.ErrPacketAuth) {
+		t.Fatalf("expected authentication failure, received: %v", err)
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	for _, s := range []*prot.SocketHandler{server, client} {
+		if s.PeerHello.ProtocolVersion != prot.ProtocolVersion {
+			t.Fatalf("expected: v%d\treceived: v%d", prot.ProtocolVersion, s.PeerHello.ProtocolVersion)
+		}
+		if s.Version != prot.ProtocolVersion {
+			t.Fatalf("expected negotiated v%d, received v%d", prot.ProtocolVersion, s.Version)
+		}
+		if s.Capabilities != prot.LocalCapabilities {
+			t.Fatalf("expected capabilities %s, received %s", prot.LocalCapabilities, s.Capabilities)
+		}
+	}
+}
+
+func TestDecisionRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sent prot.Decision
+	}{
+		{"accept all", prot.Decision{Accepted: true}},
+		{"accept some", prot.Decision{Accepted: true, Files: []string{"a.txt", "dir/b.txt"}}},
+		{"accept none", prot.Decision{Accepted: true, Files: []string{}}},
+		{"reject", prot.Decision{Reason: "too large"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := newSocketPair(t)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.SendDecision(server, tc.sent)
+			}()
+			d, err := client.ReceiveDecision(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+			if d.Accepted != tc.sent.Accepted || d.Reason != tc.sent.Reason ||
+				!slices.Equal(d.Files, tc.sent.Files) || (d.Files == nil) != (tc.sent.Files == nil) {
+				t.Fatalf("expected %+v, received %+v", tc.sent, d)
+			}
+		})
+	}
+}
+
+func TestFileHashesRoundTrip(t *testing.T) {
+	hashes := []dir.FileHash{
+		{Name: "a.txt", Hash: "00ff", Size: 12},
+		{Name: "b.jpg", Hash: "ff00", Size: 1 << 40},
+	}
+
+	var pkt prot.Packet
+	if err := pkt.SerializeToBody(hashes, prot.FileHashes); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []dir.FileHash
+	if err := pkt.DeserializeBody(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(hashes, decoded) {
+		t.Fatalf("expected: %v\treceived: %v", hashes, decoded)
+	}
+
+	// Truncated bodies must be rejected
+	pkt.Body = pkt.Body[:len(pkt.Body)-1]
+	if err := pkt.DeserializeBody(&decoded); !errors.Is(err, prot.ErrMalformed) {
+		t.Fatalf("expected malformed, received: %v", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], prot.MaxFrameSize+1)
+
+	fr := prot.NewFrameReader(bytes.NewReader(header[:]))
+	if _, err := fr.ReadFrame(); !errors.Is(err, prot.ErrFrameTooLarge) {
+		t.Fatalf("expected frame too large, received: %v", err)
+	}
+}
+
+func TestUploadDownloadFile(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src.bin")
+	dst := filepath.Join(tmp, "dst.bin")
+	data := make([]byte, 3*prot.MaxBodySize+17)
+	rand.Read(data)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.UploadFile(context.Background(), src)
+	}()
+	if err := server.DownloadFile(context.Background(), dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Fatal("downloaded file does not match upload")
+	}
+}
+
+func TestFileHashesChunked(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	hashes := make([]dir.FileHash, 5000)
+	for i := range hashes {
+		hashes[i] = dir.FileHash{
+			Name: fmt.Sprintf("file-%05d.txt", i),
+			Hash: strings.Repeat("ab", 32),
+			Size: int64(i),
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.SendFileHashes(hashes)
+	}()
+	received, err := server.ReceiveFileHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(hashes, received) {
+		t.Fatal("received file hashes do not match")
+	}
+}
+
+func TestDownloadRejectsBadHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		size     int64
+		packets  int64
+		expected error
+	}{
+		{"negative size", -1, 0, prot.ErrInvalidFileSize},
+		{"count mismatch", 10, 5, prot.ErrPacketCountMismatch},
+		{"over budget", 1 << 20, prot.CalculatePktNum(1 << 20), prot.ErrSessionBudgetExceeded},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := newSocketPair(t)
+			server.Limits.MaxSessionBytes = 1024
+
+			go func() {
+				for _, n := range []int64{tc.size, tc.packets} {
+					var pkt prot.Packet
+					pkt.SerializeToBody(n, prot.Int64)
+					client.SendEncryptedPacket(pkt)
+				}
+			}()
+
+			dst := filepath.Join(t.TempDir(), "dst.bin")
+			err := server.DownloadFile(context.Background(), dst)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected %v, received: %v", tc.expected, err)
+			}
+			if _, err := os.Stat(dst); !os.IsNotExist(err) {
+				t.Fatal("rejected download created a file")
+			}
+		})
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server, _ := newSocketPair(t)
+	server.Timeouts.Packet = 50 * time.Millisecond
+
+	var pkt prot.Packet
+	err := server.ReceiveEncryptedPacket(&pkt)
+	if !errors.Is(err, prot.ErrReadTimeout) {
+		t.Fatalf("expected read timeout, received: %v", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// The client never answers the key exchange
+	go io.Copy(io.Discard, clientConn)
+
+	timeouts := prot.DefaultTimeouts()
+	timeouts.Handshake = 100 * time.Millisecond
+	_, err := prot.NewSocketHandlerWithTimeouts(serverConn, true, timeouts)
+
+	var te *prot.TimeoutError
+	if !errors.As(err, &te) || te.Op != "handshake" {
+		t.Fatalf("expected handshake timeout, received: %v", err)
+	}
+}
+
+func TestHeartbeatKeepsPeerAlive(t *testing.T) {
+	server, client := newSocketPair(t)
+	server.Timeouts.Packet = 150 * time.Millisecond
+	client.Timeouts.Heartbeat = 30 * time.Millisecond
+
+	// Stay busy for longer than the server's packet timeout
+	go func() {
+		stop := client.StartHeartbeat(client)
+		time.Sleep(500 * time.Millisecond)
+		stop()
+		var pkt prot.Packet
+		pkt.SerializeToBody(int64(7), prot.Int64)
+		client.SendEncryptedPacket(pkt)
+	}()
+
+	var n int64
+	if err := server.ReceiveEncryptedData(&n, prot.Int64); err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Fatalf("expected 7, received %d", n)
+	}
+}
+
+func TestDownloadCanceled(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	// Announce three packets but send only one
+	go func() {
+		for _, n := range []int64{3 * prot.MaxBodySize, 3} {
+			var pkt prot.Packet
+			pkt.SerializeToBody(n, prot.Int64)
+			client.SendEncryptedPacket(pkt)
+		}
+		client.SendEncryptedPacket(prot.Packet{Body: make([]byte, prot.MaxBodySize), Type: prot.FileData})
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	dst := filepath.Join(t.TempDir(), "dst.bin")
+	err := server.DownloadFile(ctx, dst)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, received: %v", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatal("canceled download left a partial file")
+	}
+}
+
+func TestPeerCancel(t *testing.T) {
+	server, client := newSocketPair(t)
+
+	go client.SendCancel("user interrupted")
+
+	var pkt prot.Packet
+	err := server.ReceiveEncryptedPacket(&pkt)
+	if !errors.Is(err, prot.ErrPeerCanceled) {
+		t.Fatalf("expected peer canceled, received: %v", err)
+	}
+	if !strings.Contains(err.Error(), "user interrupted") {
+		t.Fatalf("expected reason in error, received: %v", err)
+	}
+}
+
+// Create a connected pair of multiplexed sessions
+func newMuxPair(t *testing.T) (*prot.Mux, *prot.Mux) {
+	t.Helper()
+	server, client := newSocketPair(t)
+	if !server.Supports(prot.CapMultiplex) {
+		t.Fatal("expected multiplexing to be negotiated")
+	}
+	return prot.NewMux(server, false), prot.NewMux(client, true)
+}
+
+func TestMuxInterleavedStreams(t *testing.T) {
+	serverMux, clientMux := newMuxPair(t)
+
+	tmp := t.TempDir()
+	const files = 4
+	data := make([][]byte, files)
+	for i := range files {
+		data[i] = make([]byte, (i+1)*prot.MaxBodySize+i)
+		rand.Read(data[i])
+		os.WriteFile(filepath.Join(tmp, fmt.Sprintf("src-%d", i)), data[i], 0644)
+	}
+
+	// Upload every file concurrently, each on its own stream
+	errCh := make(chan error, files+1)
+	for i := range files {
+		go func() {
+			st, err := clientMux.OpenStream()
+			if err == nil {
+				err = st.SendEncryptedPacket(int64Packet(int64(i)))
+			}
+			if err == nil {
+				err = st.UploadFile(context.Background(), filepath.Join(tmp, fmt.Sprintf("src-%d", i)))
+			}
+			if err == nil {
+				err = st.Close()
+			}
+			errCh <- err
+		}()
+	}
+
+	// Control traffic flows while files are in flight
+	go func() {
+		errCh <- clientMux.Control().SendEncryptedPacket(int64Packet(42))
+	}()
+	var ctrl int64
+	if err := serverMux.Control().ReceiveEncryptedData(&ctrl, prot.Int64); err != nil {
+		t.Fatal(err)
+	}
+	if ctrl != 42 {
+		t.Fatalf("expected: 42\treceived: %d", ctrl)
+	}
+
+	downloadErr := make(chan error, files)
+	for range files {
+		st, err := serverMux.AcceptStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			var i int64
+			err := st.ReceiveEncryptedData(&i, prot.Int64)
+			if err == nil {
+				err = st.DownloadFile(context.Background(), filepath.Join(tmp, fmt.Sprintf("dst-%d", i)))
+			}
+			downloadErr <- err
+		}()
+	}
+
+	for range files {
+		if err := <-downloadErr; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range files + 1 {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range files {
+		received, err := os.ReadFile(filepath.Join(tmp, fmt.Sprintf("dst-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[i], received) {
+			t.Fatalf("file %d does not match upload", i)
+		}
+	}
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	serverMux, clientMux := newMuxPair(t)
+
+	go func() {
+		st, _ := clientMux.OpenStream()
+		st.Close()
+	}()
+
+	st, err := serverMux.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkt prot.Packet
+	if err := st.ReceiveEncryptedPacket(&pkt); err != io.EOF {
+		t.Fatalf("expected EOF, received: %v", err)
+	}
+}
+
+// A canceled accept leaves the next stream to a later accept
+func TestMuxAcceptCanceled(t *testing.T) {
+	serverMux, clientMux := newMuxPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := serverMux.AcceptStream(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the accept to be canceled, received: %v", err)
+	}
+
+	opened, err := clientMux.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := serverMux.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != opened.ID {
+		t.Fatalf("expected stream %d, accepted %d", opened.ID, st.ID)
+	}
+}
+
+// Data on a stream the peer already closed fails the session instead of
+// panicking the reader
+func TestMuxDataAfterClose(t *testing.T) {
+	server, client := newSocketPair(t)
+	serverMux := prot.NewMux(server, false)
+
+	streamPacket := func(typ prot.PacketType, data bool) prot.Packet {
+		var w prot.BodyWriter
+		w.Uint32(1)
+		if data {
+			w.Uint8(uint8(prot.Int64))
+			w.Int64(7)
+		}
+		return prot.Packet{Body: w.Bytes(), Type: typ}
+	}
+	go func() {
+		client.SendEncryptedPacket(streamPacket(prot.StreamOpen, false))
+		client.SendEncryptedPacket(streamPacket(prot.StreamClose, false))
+		client.SendEncryptedPacket(streamPacket(prot.StreamData, true))
+	}()
+
+	var pkt prot.Packet
+	err := serverMux.Control().ReceiveEncryptedPacket(&pkt)
+	if !errors.Is(err, prot.ErrFlowControl) {
+		t.Fatalf("expected flow control error, received: %v", err)
+	}
+}
+
+func int64Packet(n int64) prot.Packet {
+	var pkt prot.Packet
+	pkt.SerializeToBody(n, prot.Int64)
+	return pkt
+}
+
+func TestMuxBatch(t *testing.T) {
+	serverMux, clientMux := newMuxPair(t)
+
+	tmp := t.TempDir()
+	var files []prot.BatchFile
+	for i := range 200 {
+		name := fmt.Sprintf("small-%03d.txt", i)
+		path := filepath.Join(tmp, name)
+		os.WriteFile(path, bytes.Repeat([]byte{byte(i)}, i*37), 0644)
+		files = append(files, prot.BatchFile{Name: name, Path: path})
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		st, err := clientMux.OpenStream()
+		if err == nil {
+			err = st.UploadBatch(context.Background(), files)
+		}
+		errCh <- err
+	}()
+
+	st, err := serverMux.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first prot.Packet
+	if err := st.ReceiveEncryptedPacket(&first); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	n, err := st.DownloadBatch(context.Background(), first, func(name string) (string, error) {
+		return filepath.Join(dst, name), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if n != len(files) {
+		t.Fatalf("expected: %d files\treceived: %d", len(files), n)
+	}
+
+	for _, f := range files {
+		sent, _ := os.ReadFile(f.Path)
+		received, err := os.ReadFile(filepath.Join(dst, f.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sent, received) {
+			t.Fatalf("%s does not match upload", f.Name)
+		}
+	}
+}
+
+// Counts bytes written to a connection
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	cases := []struct {
+		name       string
+		file       string
+		mode       prot.CompressionMode
+		compressed bool
+	}{
+		{"auto text", "log.txt", prot.CompressAuto, true},
+		{"auto jpeg", "photo.jpg", prot.CompressAuto, false},
+		{"always jpeg", "photo.jpg", prot.CompressAlways, true},
+		{"never text", "log.txt", prot.CompressNever, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			serverConn, rawClientConn := net.Pipe()
+			clientConn := &countingConn{Conn: rawClientConn}
+			server, client := newSocketPairOver(t, serverConn, clientConn)
+			client.Compression = tc.mode
+
+			tmp := t.TempDir()
+			src := filepath.Join(tmp, tc.file)
+			dst := filepath.Join(tmp, "dst")
+			data := bytes.Repeat([]byte("fsync compresses repetitive logs\n"), 10000)
+			os.WriteFile(src, data, 0644)
+
+			before := clientConn.written
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- client.UploadFile(context.Background(), src)
+			}()
+			if err := server.DownloadFile(context.Background(), dst); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			received, _ := os.ReadFile(dst)
+			if !bytes.Equal(data, received) {
+				t.Fatal("downloaded file does not match upload")
+			}
+			sent := clientConn.written - before
+			if compressed := sent < int64(len(data))/2; compressed != tc.compressed {
+				t.Fatalf("expected compressed: %v, sent %d bytes for %d", tc.compressed, sent, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+func TestParseSchedule(t *testing.T) {
+	sched, err := prot.ParseSchedule("2M,22:00-07:00=off,12:00-13:00=512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(clock string) time.Time {
+		tod, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 10, 7, tod.Hour(), tod.Minute(), 0, 0, time.Local)
+	}
+	cases := []struct {
+		clock    string
+		expected int64
+	}{
+		{"09:00", 2 << 20},
+		{"12:30", 512 << 10},
+		{"23:15", 0},
+		{"03:00", 0},
+		{"07:00", 2 << 20},
+	}
+	for _, tc := range cases {
+		if rate := sched.RateAt(at(tc.clock)); rate != tc.expected {
+			t.Fatalf("at %s expected: %d\treceived: %d", tc.clock, tc.expected, rate)
+		}
+	}
+
+	for _, bad := range []string{"fast", "1M,22:00=off", "1M,25:00-01:00=1K", "-5K", "NaN", "infM", "1e30G"} {
+		if _, err := prot.ParseSchedule(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// Errors quote the rate as typed
+func TestParseRateError(t *testing.T) {
+	_, err := prot.ParseRate(" 2xM")
+	if err == nil || !strings.Contains(err.Error(), `" 2xM"`) {
+		t.Fatalf("expected the original input in the error, got %v", err)
+	}
+}
+
+func TestLimitedConnPacesWrites(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	const rate = 1 << 20
+	limited := prot.NewLimitedConn(clientConn, &prot.Schedule{Default: rate}, nil)
+
+	go io.Copy(io.Discard, serverConn)
+
+	// Half a second of data past the initial burst
+	data := make([]byte, rate/8+rate/2)
+	start := time.Now()
+	if _, err := limited.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("wrote %d bytes in %v, faster than %d B/s", len(data), elapsed, rate)
+	}
+}
+
+// Waiting for the rate limit ends at the connection's deadlines, including
+// one moved earlier while waiting
+func TestLimitedConnWaitHonorsDeadlines(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	limited := prot.NewLimitedConn(clientConn, &prot.Schedule{Default: 1 << 10}, &prot.Schedule{Default: 1 << 10})
+
+	go io.Copy(io.Discard, serverConn)
+	limited.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if _, err := limited.Write(make([]byte, 64<<10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to time out, received: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("write waited %v past its deadline", elapsed)
+	}
+
+	go serverConn.Write(make([]byte, 64<<10))
+	time.AfterFunc(100*time.Millisecond, func() { limited.SetReadDeadline(time.Now()) })
+	start = time.Now()
+	buf := make([]byte, 64<<10)
+	var err error
+	for err == nil {
+		_, err = limited.Read(buf)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, received: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("read waited %v past its deadline", elapsed)
+	}
+}
+
+// Connections limited by the same schedule share its rate
+func TestLimitedConnSharesSchedule(t *testing.T) {
+	const rate = 1 << 20
+	sched := &prot.Schedule{Default: rate}
+
+	// Each write alone takes under 200ms, together they take 500ms
+	data := make([]byte, rate/16+rate/4)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range 2 {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		go io.Copy(io.Discard, serverConn)
+
+		limited := prot.NewLimitedConn(clientConn, sched, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := limited.Write(data); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("wrote %d bytes in %v, faster than %d B/s", 2*len(data), elapsed, rate)
+	}
+}
+
+// Every session with a peer shares its bandwidth override
+func TestPeerBandwidthLimitsShared(t *testing.T) {
+	peer := prot.Peer{IP: "192.0.2.7", Port: "8080", BwLimitUp: "1M"}
+	first, _, err := peer.BandwidthLimits(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := peer.BandwidthLimits(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected sessions with the same peer to share its upload schedule")
+	}
+
+	peer.BwLimitUp = "2M"
+	changed, _, err := peer.BandwidthLimits(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first || changed.Default != 2<<20 {
+		t.Fatalf("expected a changed override to take effect, got %+v", changed)
+	}
+}
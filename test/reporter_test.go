@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sebastian-j-ibanez/fsync/status"
+)
+
+func TestParseProgressStyle(t *testing.T) {
+	for _, s := range []string{"auto", "bar", "log", "total", "none"} {
+		if _, err := status.ParseProgressStyle(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	if _, err := status.ParseProgressStyle("fancy"); err == nil {
+		t.Fatal("expected an invalid style to be rejected")
+	}
+}
+
+// Every style copes with empty files and failed transfers
+func TestReportersEmptyFile(t *testing.T) {
+	for _, style := range []status.ProgressStyle{status.ProgressBar, status.ProgressLog, status.ProgressTotal, status.ProgressNone} {
+		r := status.NewReporter(style, 2, 10)
+		empty := r.Start(status.FileTransfer{Peer: "peer", File: "empty.txt"})
+		empty.Progress(0)
+		empty.Done(nil)
+		failed := r.Start(status.FileTransfer{Peer: "peer", File: "data.bin", Upload: true, Total: 10})
+		failed.Progress(4)
+		failed.Done(errors.New("connection reset"))
+	}
+}
+
+func TestTransfersReporter(t *testing.T) {
+	ts := status.NewTransfers()
+	r := status.Multi(status.Silent, ts)
+
+	empty := r.Start(status.FileTransfer{Peer: "peer", File: "empty.txt"})
+	data := r.Start(status.FileTransfer{Peer: "peer", File: "data.bin", Upload: true, Total: 10})
+	data.Progress(4)
+
+	list := ts.List()
+	if len(list) != 2 || list[0].File != "empty.txt" || list[1].Done != 4 || list[1].Total != 10 || !list[1].Upload {
+		t.Fatalf("unexpected transfers %+v", list)
+	}
+
+	empty.Done(nil)
+	data.Done(errors.New("connection reset"))
+	if list := ts.List(); len(list) != 0 {
+		t.Fatalf("finished transfers still listed: %+v", list)
+	}
+
+	// A nil *Transfers tracks nothing
+	var none *status.Transfers
+	none.Start(status.FileTransfer{File: "x"}).Done(nil)
+	if none.List() != nil {
+		t.Fatal("nil transfers listed something")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Reserve a local address with nothing listening on it
+func closedAddr(t *testing.T) prot.Peer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+	lis.Close()
+	return prot.Peer{IP: host, Port: port}
+}
+
+func TestInitSyncRetriesEveryPeer(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []prot.Peer{closedAddr(t), closedAddr(t)}
+	c := clt.Client{
+		DirMan: *d,
+		Peers:  peers,
+		Retry:  &clt.RetryPolicy{Retries: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond},
+	}
+
+	err = c.InitSync(context.Background(), nil)
+	var syncErr *clt.SyncError
+	if !errors.As(err, &syncErr) {
+		t.Fatalf("expected sync error, received: %v", err)
+	}
+	if len(syncErr.Results) != len(peers) {
+		t.Fatalf("expected %d results, received %d", len(peers), len(syncErr.Results))
+	}
+	for i, res := range syncErr.Results {
+		if res.Peer != peers[i] || res.Attempts != 3 || res.Err == nil {
+			t.Fatalf("unexpected result for peer %d: %+v", i, res)
+		}
+	}
+	if !strings.Contains(err.Error(), "2 of 2 peers") {
+		t.Fatalf("expected summary of both peers, received: %v", err)
+	}
+}
+
+func TestInitSyncStopsRetryingWhenCanceled(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clt.Client{
+		DirMan: *d,
+		Peers:  []prot.Peer{closedAddr(t)},
+		Retry:  &clt.RetryPolicy{Retries: 5, BaseDelay: time.Minute, MaxDelay: time.Minute},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = c.InitSync(ctx, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, received: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("backoff ignored cancellation")
+	}
+}
+
+// A peer dropping the connection after accepting is not asked again
+func TestInitSyncNoRetryAfterAccept(t *testing.T) {
+	clientDir := parallelDir(t, 1, unreadBlocksSize)
+	peer, accepted := listenForSync(t)
+	c := clt.Client{
+		DirMan: *clientDir,
+		Peers:  []prot.Peer{peer},
+		Retry:  &clt.RetryPolicy{Retries: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.InitSync(ctx, nil)
+	}()
+
+	f := <-accepted
+	f.accept(t)
+	f.sock.Conn.Close()
+
+	var syncErr *clt.SyncError
+	if err := <-errCh; !errors.As(err, &syncErr) {
+		t.Fatalf("expected sync error, received: %v", err)
+	}
+	if res := syncErr.Results[0]; res.Attempts != 1 {
+		t.Fatalf("expected a single attempt, made %d: %v", res.Attempts, res.Err)
+	}
+}
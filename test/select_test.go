@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+var (
+	stdinOnce  sync.Once
+	stdinInput *os.File
+)
+
+// Type input at the download prompt of every sync in this test binary
+func typeAtPrompt(t *testing.T, input string) {
+	t.Helper()
+	stdinOnce.Do(func() {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdin = r
+		stdinInput = w
+	})
+	if _, err := stdinInput.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Push files to a server deciding with approve, or the stdin prompt when
+// nil, and list the files it received
+func syncSelection(t *testing.T, files []string, approve func(context.Context, clt.Approval) (prot.Decision, error)) ([]string, error) {
+	t.Helper()
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(clientDir.Path, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := clt.Client{DirMan: *serverDir, Approve: approve}
+	peer := startServer(t, &server)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := clt.Client{DirMan: *clientDir, Peers: []prot.Peer{peer}, Retry: &clt.RetryPolicy{}}
+	err = c.InitSync(ctx, nil)
+
+	entries, _ := os.ReadDir(serverDir.Path)
+	var received []string
+	for _, e := range entries {
+		received = append(received, e.Name())
+	}
+	return received, err
+}
+
+// Numbers, ranges and patterns typed at the prompt toggle offered files
+func TestPromptSelection(t *testing.T) {
+	files := []string{"a.txt", "b.jpg", "c.jpg", "d.txt"}
+	for _, tc := range []struct {
+		name     string
+		input    string
+		received []string
+	}{
+		{"accept all", "y\n", files},
+		{"number", "2\ny\n", []string{"a.txt", "c.jpg", "d.txt"}},
+		{"several numbers", "1 4\ny\n", []string{"b.jpg", "c.jpg"}},
+		{"range", "2-4\ny\n", []string{"a.txt"}},
+		{"pattern", "*.jpg\ny\n", []string{"a.txt", "d.txt"}},
+		{"toggle twice", "*.jpg\n2\ny\n", []string{"a.txt", "b.jpg", "d.txt"}},
+		{"none then pick", "none\n3 d.txt\ny\n", []string{"c.jpg", "d.txt"}},
+		{"all again", "none\nall\ny\n", files},
+		// A bad field leaves the selection untouched
+		{"number out of range", "1 5\ny\n", files},
+		{"backwards range", "3-2\ny\n", files},
+		{"zero", "0\ny\n", files},
+		{"no match", "1 *.png\ny\n", files},
+		{"invalid pattern", "[\ny\n", files},
+		// Nothing picked keeps asking
+		{"nothing picked", "none\ny\n1\ny\n", []string{"a.txt"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			typeAtPrompt(t, tc.input)
+			received, err := syncSelection(t, files, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(received, tc.received) {
+				t.Fatalf("after typing %q expected %v, received %v", tc.input, tc.received, received)
+			}
+		})
+	}
+}
+
+// Accepting none of the files completes the sync without sending any
+func TestEmptySelectionSendsNothing(t *testing.T) {
+	received, err := syncSelection(t, []string{"a.txt", "b.txt"}, func(ctx context.Context, a clt.Approval) (prot.Decision, error) {
+		return prot.Decision{Accepted: true, Files: []string{}}, nil
+	})
+	if err != nil || len(received) != 0 {
+		t.Fatalf("expected nothing to be sent, got %v and %v", err, received)
+	}
+}
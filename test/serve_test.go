@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	clt "github.com/sebastian-j-ibanez/fsync/client"
+	dir "github.com/sebastian-j-ibanez/fsync/directory"
+	prot "github.com/sebastian-j-ibanez/fsync/protocol"
+)
+
+// Serve with server on a loopback port until the test ends
+// The port is listening once this returns, so clients need no retries
+func startServer(t *testing.T, server *clt.Client) prot.Peer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ServeListener(ctx, lis)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+	return prot.Peer{IP: host, Port: port}
+}
+
+func TestServeStopsWhenCanceled(t *testing.T) {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clt.Client{DirMan: *d}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, portStr, _ := net.SplitHostPort(lis.Addr().String())
+	lis.Close()
+	port, _ := strconv.Atoi(portStr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Serve(ctx, port)
+	}()
+
+	// Several clients may connect while the server runs
+	addr := net.JoinHostPort("127.0.0.1", portStr)
+	var conns []net.Conn
+	for range 3 {
+		var conn net.Conn
+		for range 50 {
+			conn, err = net.Dial("tcp", addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Push a file named name holding data from a new client to peer
+// Uploads are slowed so pushes from several clients overlap
+func pushFile(t *testing.T, peer prot.Peer, name string, data []byte) error {
+	d, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(d.Path, name), data, 0644); err != nil {
+		return err
+	}
+	c := clt.Client{
+		DirMan:      *d,
+		Peers:       []prot.Peer{peer},
+		Retry:       &clt.RetryPolicy{},
+		UploadLimit: &prot.Schedule{Default: 512 << 10},
+	}
+	return c.InitSync(context.Background(), nil)
+}
+
+// Random data, so compression does not shrink the transfer
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+// Clients sync while another client's session is still open
+func TestServeSeveralClients(t *testing.T) {
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := clt.Client{DirMan: *serverDir, Policy: &clt.Policy{AcceptAll: true}}
+	peer := startServer(t, &server)
+
+	// A client that connects and never speaks holds a session open
+	idle, err := net.Dial("tcp", peer.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	const clients = 3
+	files := make([][]byte, clients)
+	errs := make(chan error, clients)
+	for i := range clients {
+		files[i] = randomData(2 * prot.MaxBodySize)
+		go func() {
+			errs <- pushFile(t, peer, fmt.Sprintf("client%d.bin", i), files[i])
+		}()
+	}
+	for range clients {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range files {
+		got, err := os.ReadFile(filepath.Join(serverDir.Path, fmt.Sprintf("client%d.bin", i)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("expected client%d.bin to arrive intact, got %d bytes, %v", i, len(got), err)
+		}
+	}
+}
+
+// Clients pushing the same file at once write it one after the other,
+// so it ends up holding one client's copy whole
+func TestServeSerializesWritesToSamePath(t *testing.T) {
+	serverDir, err := dir.NewDirManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := clt.Client{DirMan: *serverDir, Policy: &clt.Policy{AcceptAll: true}}
+	peer := startServer(t, &server)
+
+	copies := [][]byte{randomData(6 * prot.MaxBodySize), randomData(6 * prot.MaxBodySize)}
+	errs := make(chan error, len(copies))
+	for _, data := range copies {
+		go func() {
+			errs <- pushFile(t, peer, "shared.bin", data)
+		}()
+	}
+	for range copies {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(serverDir.Path, "shared.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, copies[0]) && !bytes.Equal(got, copies[1]) {
+		t.Fatalf("expected shared.bin to hold one client's copy, got %d mixed bytes", len(got))
+	}
+}
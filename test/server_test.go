@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"net"
 	"os"
@@ -46,7 +47,7 @@ func Test2_UploadFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = s.UploadFile(testImgPath)
+	err = s.UploadFile(context.Background(), testImgPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,7 +72,7 @@ func Test3_AwaitSync(t *testing.T) {
 	}
 
 	// Await sync request
-	err = c.AwaitSync(port)
+	err = c.AwaitSync(context.Background(), port)
 	if err != nil {
 		t.Fatal(err)
 	}